@@ -2,9 +2,12 @@ module github.com/lyraproj/identity
 
 require (
 	github.com/hashicorp/go-hclog v0.8.0
+	github.com/lyraproj/data-protobuf v0.0.0-20190329160005-a909d9e1f93b
 	github.com/lyraproj/pcore v0.0.0-20190619162937-645af37a80ad
 	github.com/lyraproj/semver v0.0.0-20181213164306-02ecea2cd6a2
 	github.com/lyraproj/servicesdk v0.0.0-20190620124349-11383d404381
 	github.com/stretchr/testify v1.3.0
 	go.etcd.io/bbolt v1.3.2
+	google.golang.org/grpc v1.19.0
+	gopkg.in/yaml.v3 v3.0.0-20190502103701-55513cacd4ae
 )
@@ -0,0 +1,190 @@
+package identity
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// An auditRecord describes one mutation of the store
+type auditRecord struct {
+	Seq       int64     `json:"seq"`
+	Operation string    `json:"operation"`
+	Arguments []string  `json:"arguments"`
+	Tuples    []*tuple  `json:"tuples"`
+	Era       int64     `json:"era"`
+	Timestamp time.Time `json:"timestamp"`
+	Caller    string    `json:"caller"`
+}
+
+// Audit returns the records of the audit log that pass the given filter and that affected a tuple or reference
+// whose internal ID is prefixed by internalIDPrefix. All records, including those of operations that affected
+// no tuples, pass an empty prefix. The filter is described by SearchFiltered and applies to the era and time of
+// the record.
+//
+// Each record is a Hash with the entries seq, operation, arguments, tuples, era, timestamp, and caller. The
+// operation is the name of the method that made the change, arguments is an Array of its String arguments,
+// and tuples is an Array of the affected tuples and references, each as described for ValueTuple, in the state
+// they were left in by the operation or, when they were deleted, the state they had before. The era is the
+// current GC-era after the operation and caller is the caller given by the options of the service. Records are
+// returned in the order they were written.
+func (i *identity) Audit(_ px.Context, internalIDPrefix string, filter px.OrderedMap) px.List {
+	f := parseFilter(filter)
+	found := make([]px.Value, 0, 32)
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(audit).ForEach(func(k, v []byte) error {
+				if r := unmarshalAuditRecord(v); r.matches(f, internalIDPrefix) {
+					found = append(found, r.valueHash())
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return types.WrapValues(found)
+}
+
+// RotateAudit moves the records of the audit log that were written before the given time to the file at the
+// given path. A zero time moves all records. The records are appended to the file as JSON lines and the file is
+// synced before the records are removed from the store. The file is created with the file mode of the store
+// if it does not exist. Returns the number of records that were moved.
+func (i *identity) RotateAudit(_ px.Context, path string, before time.Time) (count int64) {
+	i.withDb(func(db *bolt.DB) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			var keys [][]byte
+			var lines []byte
+			err := tx.Bucket(audit).ForEach(func(k, v []byte) error {
+				r := unmarshalAuditRecord(v)
+				if !before.IsZero() && !r.Timestamp.Before(before) {
+					return nil
+				}
+				bs, err := json.Marshal(r)
+				if err == nil {
+					keys = append(keys, append([]byte{}, k...))
+					lines = append(append(lines, bs...), '\n')
+				}
+				return err
+			})
+			if err == nil && len(keys) > 0 {
+				err = appendFile(path, lines, i.options.FileMode)
+			}
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				deleteFromBucket(tx, audit, k)
+			}
+			count = int64(len(keys))
+			onCommit(tx, i.log.Info, "rotated audit log", "path", path, "records", count)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return
+}
+
+// audit appends a record of an operation that affected the given tuples to the audit log of the store
+func (i *identity) audit(tx *bolt.Tx, operation string, tuples []*tuple, arguments ...string) {
+	b := tx.Bucket(audit)
+	seq, err := b.NextSequence()
+	if err != nil {
+		panic(err)
+	}
+	r := &auditRecord{
+		Seq:       int64(seq),
+		Operation: operation,
+		Arguments: arguments,
+		Tuples:    tuples,
+		Era:       i.readMetadata(tx).Era,
+		Timestamp: time.Now(),
+		Caller:    i.options.Caller}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	putInBucket(tx, audit, k, marshalUnknown(`audit record`, r))
+}
+
+// affected returns the given tuples that are not nil
+func affected(ts ...*tuple) []*tuple {
+	as := make([]*tuple, 0, len(ts))
+	for _, t := range ts {
+		if t != nil {
+			as = append(as, t)
+		}
+	}
+	return as
+}
+
+func unmarshalAuditRecord(bs []byte) *auditRecord {
+	r := &auditRecord{}
+	unmarshalUnknown(`audit record`, bs, &r)
+	// Gob decodes empty slices as nil
+	if r.Arguments == nil {
+		r.Arguments = []string{}
+	}
+	if r.Tuples == nil {
+		r.Tuples = []*tuple{}
+	}
+	return r
+}
+
+// matches returns true if the record passes the filter and affected a tuple with the given prefix
+func (r *auditRecord) matches(f *tupleFilter, internalIDPrefix string) bool {
+	if !f.matches(&tuple{Era: r.Era, Timestamp: r.Timestamp}) {
+		return false
+	}
+	if internalIDPrefix == `` {
+		return true
+	}
+	for _, t := range r.Tuples {
+		if strings.HasPrefix(t.InternalID, internalIDPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *auditRecord) valueHash() px.OrderedMap {
+	args := make([]px.Value, len(r.Arguments))
+	for ix, a := range r.Arguments {
+		args[ix] = types.WrapString(a)
+	}
+	ts := make([]px.Value, len(r.Tuples))
+	for ix, t := range r.Tuples {
+		ts[ix] = t.ValueTuple()
+	}
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`seq`, types.WrapInteger(r.Seq)),
+		types.WrapHashEntry2(`operation`, types.WrapString(r.Operation)),
+		types.WrapHashEntry2(`arguments`, types.WrapValues(args)),
+		types.WrapHashEntry2(`tuples`, types.WrapValues(ts)),
+		types.WrapHashEntry2(`era`, types.WrapInteger(r.Era)),
+		types.WrapHashEntry2(`timestamp`, types.WrapTimestamp(r.Timestamp)),
+		types.WrapHashEntry2(`caller`, types.WrapString(r.Caller))})
+}
+
+// appendFile appends data to the file at the given path, creating it with the given permissions if necessary,
+// and syncs it
+func appendFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package identity
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/stretchr/testify/require"
+)
+
+func auditOperations(records px.List) []string {
+	ops := make([]string, records.Len())
+	records.EachWithIndex(func(r px.Value, ix int) { ops[ix] = r.(px.OrderedMap).Get5(`operation`, nil).String() })
+	return ops
+}
+
+func TestAuditRecords(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestAuditRecords.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		o := DefaultOptions()
+		o.DB = filename
+		o.Caller = `alice`
+		id := NewIdentityWithOptions(o)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e1")
+		id.AddReference(c, "a:i2", "b:")
+		id.BumpEra(c)
+		id.Sweep(c, "a:")
+		id.RemoveInternal(c, "a:i2")
+		id.PurgeExternal(c, "e1")
+		id.PurgeReferences(c, "a:")
+
+		records := id.Audit(c, "", nil)
+		require.Equal(t, []string{`associate`, `associate`, `addReference`, `bumpEra`, `sweep`, `removeInternal`,
+			`purgeExternal`, `purgeReferences`}, auditOperations(records))
+
+		// Associating a:i2 with e1 took it from a:i1
+		r := records.At(1).(px.OrderedMap)
+		require.Equal(t, `alice`, r.Get5(`caller`, nil).String())
+		require.EqualValues(t, 2, r.Get5(`seq`, nil).(px.Integer).Int())
+		require.Equal(t, []string{`a:i2`, `e1`}, stringList(r.Get5(`arguments`, nil).(px.List)))
+		require.Equal(t, []string{`a:i1`, `a:i2`}, tupleIDs(r.Get5(`tuples`, nil).(px.List)))
+
+		r = records.At(3).(px.OrderedMap)
+		require.EqualValues(t, 1, r.Get5(`era`, nil).(px.Integer).Int())
+		require.EqualValues(t, 0, r.Get5(`tuples`, nil).(px.List).Len())
+
+		// The sweep moved a:i2 to the garbage bin
+		require.Equal(t, []string{`a:i2`}, tupleIDs(records.At(4).(px.OrderedMap).Get5(`tuples`, nil).(px.List)))
+
+		// Prefix and filter
+		require.Equal(t, []string{`associate`, `associate`}, auditOperations(id.Audit(c, "a:i1", nil)))
+		require.Equal(t, []string{`bumpEra`, `sweep`, `removeInternal`, `purgeExternal`, `purgeReferences`},
+			auditOperations(id.Audit(c, "", filterHash(map[string]px.Value{`minEra`: types.WrapInteger(1)}))))
+	})
+}
+
+func stringList(l px.List) []string {
+	ss := make([]string, l.Len())
+	l.EachWithIndex(func(v px.Value, ix int) { ss[ix] = v.String() })
+	return ss
+}
+
+func TestRotateAudit(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestRotateAudit.db"
+		logfile := "TestRotateAudit.jsonl"
+		deleteFile(filename)
+		deleteFile(logfile)
+		defer deleteFile(filename)
+		defer deleteFile(logfile)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.BumpEra(c)
+		time.Sleep(2 * time.Millisecond)
+		cut := time.Now()
+		id.Associate(c, "a:i2", "e2")
+
+		require.EqualValues(t, 2, id.RotateAudit(c, logfile, cut))
+		require.Equal(t, []string{`associate`}, auditOperations(id.Audit(c, "", nil)))
+		require.EqualValues(t, 0, id.RotateAudit(c, logfile, cut))
+
+		// Rotation appends to the file
+		require.EqualValues(t, 1, id.RotateAudit(c, logfile, time.Time{}))
+		require.EqualValues(t, 0, id.Audit(c, "", nil).Len())
+
+		f, err := os.Open(logfile)
+		require.NoError(t, err)
+		defer f.Close()
+		var ops []string
+		var seqs []int64
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			r := &auditRecord{}
+			require.NoError(t, json.Unmarshal(s.Bytes(), r))
+			ops = append(ops, r.Operation)
+			seqs = append(seqs, r.Seq)
+		}
+		require.Equal(t, []string{`associate`, `bumpEra`, `associate`}, ops)
+		require.Equal(t, []int64{1, 2, 3}, seqs)
+
+		// Sequence numbers continue after a rotation
+		id.BumpEra(c)
+		require.EqualValues(t, 4, id.Audit(c, "", nil).At(0).(px.OrderedMap).Get5(`seq`, nil).(px.Integer).Int())
+	})
+}
@@ -0,0 +1,217 @@
+package identity
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/semver/semver"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent snapshot of the store to the file at the given path. The snapshot is written
+// using a read transaction to a temporary file which is then renamed, so the file at path is either the old
+// file or the complete snapshot. The read transaction shares the open store with other requests, which are
+// served, including writes, while the snapshot is written. Writes that grow the store beyond its memory map wait
+// for the snapshot to complete, which the initialMmapSize setting avoids.
+func (i *identity) Backup(_ px.Context, path string) {
+	tmp := path + `.tmp`
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			return writeSnapshot(tx, tmp)
+		})
+		if err != nil {
+			_ = os.Remove(tmp)
+			panic(err)
+		}
+	})
+	if err := os.Rename(tmp, path); err != nil {
+		panic(err)
+	}
+	i.log.Info("backed up identity store", "db", i.filename, "path", path)
+}
+
+// Restore replaces the store with the snapshot at the given path. The snapshot must be a store with a supported
+// version. It is upgraded to the current version and given the audit log, history, and event log of the store,
+// which a restore never rewinds, before it atomically replaces the store. Mappings that differ from those of the
+// store are appended to the history and emitted as events after a restore event, so watchers resume across the
+// restore, and the restore is recorded in the audit log. All requests are paused while the logs are carried over.
+func (i *identity) Restore(_ px.Context, path string) {
+	if err := validateSnapshot(path); err != nil {
+		panic(err)
+	}
+
+	// Copy and upgrade the snapshot next to the store so that it can be renamed
+	tmp := i.filename + `.restore`
+	if err := copyFile(path, tmp, i.options.FileMode); err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(tmp)
+	}()
+	o := *i.options
+	o.DB = tmp
+	r := newIdentity(&o)
+	r.initialize()
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	src := i.openDb()
+	defer func() {
+		_ = src.Close()
+	}()
+	r.withDb(func(db *bolt.DB) {
+		err := src.View(func(stx *bolt.Tx) error {
+			return db.Update(func(tx *bolt.Tx) error {
+				if err := carryLogs(stx, tx); err != nil {
+					return err
+				}
+				r.recordRestore(stx, tx, i.readMetadata(stx).Seq)
+				r.audit(tx, `restore`, nil, path)
+				return nil
+			})
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	if err := os.Rename(tmp, i.filename); err != nil {
+		panic(err)
+	}
+	// The events of the restore were emitted by r so the watchers of this service must be woken up here
+	i.signalChanges()
+	i.log.Info("restored identity store", "db", i.filename, "path", path)
+}
+
+// carryLogs replaces the audit log, history, and event log in tx with those in stx
+func carryLogs(stx, tx *bolt.Tx) error {
+	for _, bn := range [][]byte{audit, history, events} {
+		if err := tx.DeleteBucket(bn); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(bn)
+		if err != nil {
+			return err
+		}
+		if err = copyBucket(stx.Bucket(bn), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordRestore raises the sequence of the restored store in tx to the given sequence of the store in stx so
+// that new history entries follow those that were carried over, and appends the mappings that the restore
+// changes to the history and the event log.
+func (i *identity) recordRestore(stx, tx *bolt.Tx, seq int64) {
+	if md := i.readMetadata(tx); md.Seq < seq {
+		md.Seq = seq
+		putInBucket(tx, metadata, metadata, marshalMetadata(md))
+	}
+
+	var added, removed []*tuple
+	current := stx.Bucket(internalToExternal)
+	restored := tx.Bucket(internalToExternal)
+	err := current.ForEach(func(k, v []byte) error {
+		if restored.Get(k) == nil {
+			removed = append(removed, unmarshalTuple(v))
+		}
+		return nil
+	})
+	if err == nil {
+		err = restored.ForEach(func(k, v []byte) error {
+			t := unmarshalTuple(v)
+			if cv := current.Get(k); cv == nil || unmarshalTuple(cv).ExternalID != t.ExternalID {
+				added = append(added, t)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	i.emit(tx, EventRestore, nil)
+	for _, t := range removed {
+		i.recordRemoval(tx, t)
+		i.emit(tx, EventPurge, t)
+	}
+	now := time.Now()
+	for _, t := range added {
+		recordHistory(tx, &tuple{InternalID: t.InternalID, ExternalID: t.ExternalID, Timestamp: now, Era: t.Era, Seq: i.nextSeq(tx)})
+		i.emit(tx, EventAssociate, t)
+	}
+}
+
+func writeSnapshot(tx *bolt.Tx, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.WriteTo(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// validateSnapshot asserts that the file at the given path is an identity store with a supported version
+func validateSnapshot(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return errorf("snapshot '%s' is not a valid identity store: %s", path, err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	return db.View(func(tx *bolt.Tx) error {
+		mbb := tx.Bucket(metadata)
+		if mbb == nil || mbb.Get(metadata) == nil {
+			return errorf("snapshot '%s' has no metadata", path)
+		}
+		md := &storeMeta{}
+		if err := decodeUnknown(`metadata`, mbb.Get(metadata), &md); err != nil {
+			return errorf("snapshot '%s' has invalid metadata: %s", path, err)
+		}
+		v, err := semver.ParseVersion(md.Version)
+		if err != nil || !supportedVersions.Includes(v) {
+			return errorf("snapshot '%s' has unsupported data store version. Expected %s, got %s", path, supportedVersions, md.Version)
+		}
+		for _, bn := range [][]byte{internalToExternal, externalToInternal, garbage} {
+			if tx.Bucket(bn) == nil {
+				return errorf("snapshot '%s' has no %s bucket", path, bn)
+			}
+		}
+		return nil
+	})
+}
+
+// copyFile copies the file at src to a new file at dst with the given permissions and syncs it
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
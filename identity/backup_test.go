@@ -0,0 +1,177 @@
+package identity
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBackupRestore(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestBackupRestore.db"
+		backupName := "TestBackupRestore.bak"
+		deleteFile(filename)
+		deleteFile(backupName)
+		defer deleteFile(filename)
+		defer deleteFile(backupName)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "i1", "e1")
+		id.BumpEra(c)
+		id.Backup(c, backupName)
+		id.Associate(c, "i2", "e2")
+		id.Associate(c, "i1", "e3")
+		id.BumpEra(c)
+		token := id.Watch(c, "", "", 0).Get5(`next`, nil).String()
+
+		id.Restore(c, backupName)
+		checkGetExternal(t, c, id, "i1", "e1")
+		checkGetExternal(t, c, id, "i2", "")
+		require.EqualValues(t, 1, id.ReadEra(c))
+
+		// The audit log and history written after the backup are kept and the restored mappings are appended
+		require.Equal(t, []string{`associate`, `bumpEra`, `associate`, `associate`, `bumpEra`, `restore`},
+			auditOperations(id.Audit(c, "", nil)))
+		require.Equal(t, []string{`e2`, ``}, historyIDs(id.History(c, "i2")))
+		require.Equal(t, []string{`e1`, `e3`, `e1`}, historyIDs(id.History(c, "i1")))
+		checkAsOf(t, c, id, "i1", time.Now(), `e1`)
+		checkAsOf(t, c, id, "i2", time.Now(), ``)
+
+		// New mappings follow the history that was carried over
+		id.Associate(c, "i2", "e4")
+		require.Equal(t, []string{`e2`, ``, `e4`}, historyIDs(id.History(c, "i2")))
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+
+		// A watch token issued before the restore resumes with the changes made by the restore
+		require.Equal(t, []string{`restore`, `purge`, `associate`, `associate`}, eventKinds(id.Watch(c, "", token, 0)))
+	})
+}
+
+func TestRestoreWakesWatch(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestRestoreWakesWatch.db"
+		backupName := "TestRestoreWakesWatch.bak"
+		deleteFile(filename)
+		deleteFile(backupName)
+		defer deleteFile(filename)
+		defer deleteFile(backupName)
+		id := NewIdentity(filename)
+
+		saved := WatchPollInterval
+		WatchPollInterval = time.Minute
+		defer func() { WatchPollInterval = saved }()
+
+		// The events of the restore end the wait of a watcher at once
+		id.Backup(c, backupName)
+		id.Associate(c, "i1", "e1")
+		token := id.Watch(c, "i1", "", 0).Get5(`next`, nil).String()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			id.Restore(c, backupName)
+		}()
+		start := time.Now()
+		r := id.Watch(c, "i1", token, 30000)
+		require.Equal(t, []string{`restore`, `purge`}, eventKinds(r))
+		require.True(t, time.Since(start) < 5*time.Second)
+	})
+}
+
+func TestRestoreValidation(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestRestoreValidation.db"
+		snapshot := "TestRestoreValidation.bak"
+		deleteFile(filename)
+		deleteFile(snapshot)
+		defer deleteFile(filename)
+		defer deleteFile(snapshot)
+		id := NewIdentity(filename)
+		id.Associate(c, "i1", "e1")
+
+		require.Panics(t, func() { id.Restore(c, snapshot) })
+
+		require.NoError(t, ioutil.WriteFile(snapshot, []byte("not a store"), 0600))
+		require.Panics(t, func() { id.Restore(c, snapshot) })
+		deleteFile(snapshot)
+
+		corrupt(snapshot, func(tx *bolt.Tx) error {
+			mbb, err := tx.CreateBucket(metadata)
+			if err == nil {
+				err = mbb.Put(metadata, marshalMetadata(&storeMeta{Version: "2.0.0", Timestamp: time.Now()}))
+			}
+			return err
+		})
+		require.Panics(t, func() { id.Restore(c, snapshot) })
+		checkGetExternal(t, c, id, "i1", "e1")
+		deleteFile(snapshot)
+
+		// A 1.0.0 snapshot is upgraded
+		corrupt(snapshot, func(tx *bolt.Tx) error {
+			mbb, _ := tx.CreateBucket(metadata)
+			_ = mbb.Put(metadata, marshalMetadata(&storeMeta{Version: "1.0.0", Timestamp: time.Now()}))
+			_, _ = tx.CreateBucket(internalToExternal)
+			_, _ = tx.CreateBucket(externalToInternal)
+			_, err := tx.CreateBucket(garbage)
+			return err
+		})
+		id.Restore(c, snapshot)
+		checkGetExternal(t, c, id, "i1", "")
+		id.AddReference(c, "i2", "b:")
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+	})
+}
+
+func TestBackupWhileServing(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestBackupWhileServing.db"
+		backupName := "TestBackupWhileServing.bak"
+		deleteFile(filename)
+		deleteFile(backupName)
+		defer deleteFile(filename)
+		defer deleteFile(backupName)
+		o := DefaultOptions()
+		o.DB = filename
+		o.InitialMmapSize = 1 << 20
+		id := NewIdentityWithOptions(o)
+		id.Associate(c, "i1", "e1")
+
+		// Hold the read transaction of a backup open while other requests are made
+		started := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			id.(*identity).withDb(func(db *bolt.DB) {
+				_ = db.View(func(tx *bolt.Tx) error {
+					close(started)
+					<-release
+					return writeSnapshot(tx, backupName)
+				})
+			})
+		}()
+		<-started
+
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			id.Associate(c, "i2", "e2")
+			id.GetExternal(c, "i1")
+		}()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("requests were not served during the backup")
+		}
+		close(release)
+		<-done
+
+		// The snapshot is consistent with the start of the backup
+		id.Restore(c, backupName)
+		checkGetExternal(t, c, id, "i1", "e1")
+		checkGetExternal(t, c, id, "i2", "")
+	})
+}
@@ -0,0 +1,97 @@
+package identity
+
+import (
+	"os"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Compact rewrites the store into a fresh file which then atomically replaces the store. Bolt never shrinks its
+// file so this is the only way to reclaim the space of deleted entries. All requests of this service are paused
+// during the compaction and other processes wait for the lock of the store file until it has been replaced.
+//
+// The result is a Hash with the entries before and after containing the size of the file in bytes
+func (i *identity) Compact(_ px.Context) px.OrderedMap {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// The store stays open, and its file locked, until it has been replaced so that other processes cannot
+	// commit changes that the compacted file would lose
+	src := i.openDb()
+	defer func() {
+		_ = src.Close()
+	}()
+	before := fileSize(i.filename)
+	tmp := i.filename + `.compact`
+	err := i.compactTo(src, tmp)
+	if err == nil {
+		err = os.Rename(tmp, i.filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		panic(err)
+	}
+
+	after := fileSize(i.filename)
+	i.log.Info("compacted identity store", "db", i.filename, "before", before, "after", after)
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`before`, types.WrapInteger(before)),
+		types.WrapHashEntry2(`after`, types.WrapInteger(after))})
+}
+
+// compactTo copies all buckets of src to a new Bolt database at the given path. The new database is synced
+// regardless of the sync setting since it replaces the store.
+func (i *identity) compactTo(src *bolt.DB, path string) error {
+	_ = os.Remove(path)
+	bo := i.options.boltOptions()
+	bo.NoSync = false
+	dst, err := bolt.Open(path, i.options.FileMode, bo)
+	if err != nil {
+		return err
+	}
+
+	err = src.View(func(stx *bolt.Tx) error {
+		return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+			return dst.Update(func(dtx *bolt.Tx) error {
+				db, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(sb, db)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copyBucket copies all entries and nested buckets of src to dst
+func copyBucket(src, dst *bolt.Bucket) error {
+	// Entries are added in key order so pages can be filled completely
+	dst.FillPercent = 1.0
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nb, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), nb)
+		}
+		return dst.Put(k, v)
+	})
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+	return fi.Size()
+}
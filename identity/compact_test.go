@@ -0,0 +1,74 @@
+package identity
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCompact(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestCompact.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		for n := 0; n < 2000; n++ {
+			id.Associate(c, fmt.Sprintf("a:i%d", n), fmt.Sprintf("e%d", n))
+		}
+		id.AddReference(c, "a:i1", "b:")
+		id.BumpEra(c)
+		for n := 0; n < 1990; n++ {
+			id.PurgeInternal(c, fmt.Sprintf("a:i%d", n))
+		}
+		id.RemoveInternal(c, "a:i1995")
+		export := id.Export(c, "json")
+
+		sizes := id.Compact(c)
+		before := sizes.Get5("before", nil).(px.Integer).Int()
+		after := sizes.Get5("after", nil).(px.Integer).Int()
+		require.True(t, after < before, "expected %d to be less than %d", after, before)
+		require.EqualValues(t, after, fileSize(id.(*identity).filename))
+
+		require.Equal(t, export, id.Export(c, "json"))
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+		checkGetExternal(t, c, id, "a:i1999", "e1999")
+	})
+}
+
+func TestOpenReplacedStore(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestOpenReplacedStore.db"
+		replacement := "TestOpenReplacedStore.new"
+		deleteFile(filename)
+		deleteFile(replacement)
+		defer deleteFile(filename)
+		defer deleteFile(replacement)
+		id := NewIdentity(filename)
+		id.Associate(c, "a:i1", "e1")
+		id.Backup(c, replacement)
+
+		// Another process holds the lock of the store while it replaces the file, like Compact and Restore do
+		holder, err := bolt.Open(filename, 0600, nil)
+		require.NoError(t, err)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			id.Associate(c, "a:i2", "e2")
+		}()
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, os.Rename(replacement, filename))
+		require.NoError(t, holder.Close())
+		<-done
+
+		// The change was made to the file that replaced the store
+		checkGetExternal(t, c, id, "a:i1", "e1")
+		checkGetExternal(t, c, id, "a:i2", "e2")
+	})
+}
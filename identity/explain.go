@@ -0,0 +1,109 @@
+package identity
+
+import (
+	"fmt"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExplainGC explains whether a Sweep of sweepPrefix would move the tuple keyed by internalID to the garbage bin.
+//
+// The result is a Hash with the entries internalId, status ('live', 'garbage', or 'unknown'), externalId and era
+// of the tuple (when found), currentEra, path, eligible, and a human readable reason. The path is the chain of
+// prefixes from the sweep prefix to the one that includes the internal ID where each element but the first also
+// contains the reference (via, era, and timestamp) that brought it into scope. It is empty when the internal ID
+// is not in scope of the sweep.
+func (i *identity) ExplainGC(_ px.Context, internalID, sweepPrefix string) (result px.OrderedMap) {
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			era := i.readMetadata(tx).Era
+			refsInEra, err := readReferences(tx, func(r *reference) bool { return r.Era < era })
+			if err != nil {
+				return err
+			}
+
+			status := `live`
+			t := readTuple(tx, []byte(internalID))
+			if t == nil {
+				status = `garbage`
+				if t, err = findGarbage(tx, internalID); err != nil {
+					return err
+				}
+				if t == nil {
+					status = `unknown`
+				}
+			}
+
+			es := make([]*types.HashEntry, 0, 8)
+			es = append(es, types.WrapHashEntry2(`internalId`, types.WrapString(internalID)))
+			es = append(es, types.WrapHashEntry2(`status`, types.WrapString(status)))
+			if t != nil {
+				es = append(es, types.WrapHashEntry2(`externalId`, types.WrapString(t.ExternalID)))
+				es = append(es, types.WrapHashEntry2(`era`, types.WrapInteger(t.Era)))
+			}
+			es = append(es, types.WrapHashEntry2(`currentEra`, types.WrapInteger(era)))
+
+			path := make([]px.Value, 0, 4)
+			s := findScope(expandScopes(refsInEra, sweepPrefix), internalID)
+			if s != nil {
+				for _, ps := range s.path() {
+					path = append(path, ps.valueHash())
+				}
+			}
+			es = append(es, types.WrapHashEntry2(`path`, types.WrapValues(path)))
+
+			var reason string
+			switch {
+			case t == nil:
+				reason = fmt.Sprintf("no tuple is keyed by internal ID '%s'", internalID)
+			case status == `garbage`:
+				reason = `the tuple is already in the garbage bin`
+			case s == nil:
+				reason = fmt.Sprintf("internal ID '%s' is not in scope of a sweep of '%s'", internalID, sweepPrefix)
+			case t.Era >= era:
+				reason = fmt.Sprintf("GC era %d of the tuple is not lower than the current era %d", t.Era, era)
+			case s.via == nil:
+				reason = fmt.Sprintf("GC era %d of the tuple is lower than the current era %d and the internal ID is prefixed by '%s'",
+					t.Era, era, sweepPrefix)
+			default:
+				reason = fmt.Sprintf("GC era %d of the tuple is lower than the current era %d and the internal ID is prefixed by '%s' which is referenced from '%s'",
+					t.Era, era, s.prefix, s.via.InternalID)
+			}
+			eligible := status == `live` && s != nil && t.Era < era
+			es = append(es, types.WrapHashEntry2(`eligible`, types.WrapBoolean(eligible)))
+			es = append(es, types.WrapHashEntry2(`reason`, types.WrapString(reason)))
+			result = types.WrapHash(es)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return
+}
+
+// valueHash returns a Hash describing the scope
+func (s *scope) valueHash() px.OrderedMap {
+	es := make([]*types.HashEntry, 0, 4)
+	es = append(es, types.WrapHashEntry2(`prefix`, types.WrapString(s.prefix)))
+	if s.via != nil {
+		es = append(es, types.WrapHashEntry2(`via`, types.WrapString(s.via.InternalID)))
+		es = append(es, types.WrapHashEntry2(`era`, types.WrapInteger(s.via.Era)))
+		es = append(es, types.WrapHashEntry2(`timestamp`, types.WrapTimestamp(s.via.Timestamp)))
+	}
+	return types.WrapHash(es)
+}
+
+// findGarbage returns the tuple in the garbage bin that is keyed by the given internal ID, or nil if no such
+// tuple exists
+func findGarbage(tx *bolt.Tx, internalID string) (found *tuple, err error) {
+	err = tx.Bucket(garbage).ForEach(func(k, v []byte) error {
+		if t := unmarshalTuple(v); t.InternalID == internalID {
+			found = t
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,57 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainGC(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestExplainGC.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.AddReference(c, "a:i3", "b:")
+		id.Associate(c, "b:i1", "e3")
+		id.Associate(c, "x:i1", "e4")
+		id.BumpEra(c)
+		checkGetExternal(t, c, id, "a:i1", "e1")
+		id.RemoveInternal(c, "a:i2")
+
+		ex := id.ExplainGC(c, "b:i1", "a:")
+		require.Equal(t, "live", ex.Get5("status", nil).String())
+		require.Equal(t, "e3", ex.Get5("externalId", nil).String())
+		require.True(t, ex.Get5("eligible", nil).(px.Boolean).Bool())
+		path := ex.Get5("path", nil).(px.List)
+		require.Equal(t, 2, path.Len())
+		require.Equal(t, "a:", path.At(0).(px.OrderedMap).Get5("prefix", nil).String())
+		require.Equal(t, "b:", path.At(1).(px.OrderedMap).Get5("prefix", nil).String())
+		require.Equal(t, "a:i3", path.At(1).(px.OrderedMap).Get5("via", nil).String())
+
+		// Accessed in current era
+		ex = id.ExplainGC(c, "a:i1", "a:")
+		require.False(t, ex.Get5("eligible", nil).(px.Boolean).Bool())
+		require.EqualValues(t, 1, ex.Get5("era", nil).(px.Integer).Int())
+		require.EqualValues(t, 1, ex.Get5("currentEra", nil).(px.Integer).Int())
+
+		// Not in scope
+		ex = id.ExplainGC(c, "x:i1", "a:")
+		require.False(t, ex.Get5("eligible", nil).(px.Boolean).Bool())
+		require.Equal(t, 0, ex.Get5("path", nil).(px.List).Len())
+
+		// Already garbage
+		ex = id.ExplainGC(c, "a:i2", "a:")
+		require.Equal(t, "garbage", ex.Get5("status", nil).String())
+		require.False(t, ex.Get5("eligible", nil).(px.Boolean).Bool())
+
+		ex = id.ExplainGC(c, "a:i9", "a:")
+		require.Equal(t, "unknown", ex.Get5("status", nil).String())
+		require.False(t, ex.Get5("eligible", nil).(px.Boolean).Bool())
+	})
+}
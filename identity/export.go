@@ -0,0 +1,274 @@
+package identity
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/lyraproj/semver/semver"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// A document is the exported form of an identity store
+type document struct {
+	Version    string       `json:"version" yaml:"version"`
+	Era        int64        `json:"era" yaml:"era"`
+	Timestamp  time.Time    `json:"timestamp" yaml:"timestamp"`
+	Mappings   []*tuple     `json:"mappings" yaml:"mappings"`
+	Garbage    []*tuple     `json:"garbage" yaml:"garbage"`
+	References []*reference `json:"references" yaml:"references"`
+}
+
+// Conflict handling strategies for Import
+const (
+	ConflictFail      = `fail`
+	ConflictOverwrite = `overwrite`
+	ConflictSkip      = `skip`
+)
+
+// Export returns all mappings, garbage, references, and the metadata of the store as a document in the given
+// format, which must be either "json" or "yaml". The document can be loaded into a store using Import.
+func (i *identity) Export(_ px.Context, format string) string {
+	doc := &document{Mappings: make([]*tuple, 0, 32), Garbage: make([]*tuple, 0), References: make([]*reference, 0)}
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			md := i.readMetadata(tx)
+			doc.Version = md.Version
+			doc.Era = md.Era
+			doc.Timestamp = md.Timestamp
+			err := tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+				doc.Mappings = append(doc.Mappings, unmarshalTuple(v))
+				return nil
+			})
+			if err == nil {
+				err = tx.Bucket(garbage).ForEach(func(k, v []byte) error {
+					doc.Garbage = append(doc.Garbage, unmarshalTuple(v))
+					return nil
+				})
+			}
+			if err == nil {
+				err = tx.Bucket(references).ForEach(func(k, v []byte) error {
+					doc.References = append(doc.References, unmarshalReference(v))
+					return nil
+				})
+			}
+			return err
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return doc.encode(format)
+}
+
+// Import loads a document in the given format, "json" or "yaml", into the store. The era of the store is raised
+// to the era of the document if it is lower.
+//
+// A mapping in the document conflicts with the store when its internal or external ID is part of another mapping
+// in the store and a garbage entry conflicts when the store has a garbage entry or a mapping for the same external
+// ID from another internal ID. The onConflict argument determines how conflicts are handled:
+//
+//	fail       the import fails and the store is left unchanged
+//	overwrite  the conflicting mappings or garbage entries in the store are replaced
+//	skip       the conflicting mappings or garbage entries of the document are ignored
+//
+// Mappings and references that already exist in the store retain the highest of the two eras. Imported mappings
+// remove the garbage entries of their external IDs, just like Associate does. Imported records are renumbered
+// after the current sequence number of the store in the order of their exported sequence numbers, so they keep
+// their relative order and are ordered after everything already in the store. They keep their exported
+// timestamps. Imported mappings are appended to the history of their internal IDs at the time of the import. The
+// history itself is not part of the document.
+//
+// The result is a Hash with the entries mappings, garbage, and references containing the number of records
+// that were imported and skipped containing the number of records that were ignored due to conflicts.
+func (i *identity) Import(_ px.Context, data, format, onConflict string) (result px.OrderedMap) {
+	switch onConflict {
+	case ConflictFail, ConflictOverwrite, ConflictSkip:
+	default:
+		panic(errorf("unknown conflict handling '%s'. Expected fail, overwrite, or skip", onConflict))
+	}
+	doc := decodeDocument(data, format)
+
+	var mappings, gbg, refs, skipped int64
+	i.withDb(func(db *bolt.DB) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			var ts []*tuple
+			now := time.Now()
+			md := i.readMetadata(tx)
+			if doc.Era > md.Era {
+				md.Era = doc.Era
+			}
+			md.Seq = doc.renumber(md.Seq)
+			putInBucket(tx, metadata, metadata, marshalMetadata(md))
+
+			for _, t := range doc.Mappings {
+				iid := []byte(t.InternalID)
+				eid := []byte(t.ExternalID)
+				existing := readTuple(tx, iid)
+				if existing != nil && existing.ExternalID == t.ExternalID {
+					if t.Era > existing.Era {
+						existing.Era = t.Era
+						putInBucket(tx, internalToExternal, iid, marshalTuple(existing))
+					}
+					deleteFromBucket(tx, garbage, eid)
+					mappings++
+					continue
+				}
+
+				if owner := tx.Bucket(externalToInternal).Get(eid); existing != nil || owner != nil {
+					switch onConflict {
+					case ConflictFail:
+						return errorf("mapping from '%s' to '%s' conflicts with the store", t.InternalID, t.ExternalID)
+					case ConflictSkip:
+						skipped++
+						continue
+					}
+					i.emit(tx, EventPurge, i.removeInternal(tx, iid, false))
+					stolen := i.removeExternal(tx, eid, false)
+					i.recordRemoval(tx, stolen)
+					i.emit(tx, EventPurge, stolen)
+				}
+				importTimes(t, now)
+				putInBucket(tx, internalToExternal, iid, marshalTuple(t))
+				putInBucket(tx, externalToInternal, eid, iid)
+				deleteFromBucket(tx, garbage, eid)
+
+				// The history records when the mapping was made in this store
+				h := *t
+				h.Timestamp = now
+				recordHistory(tx, &h)
+				i.emit(tx, EventAssociate, t)
+				ts = append(ts, t)
+				mappings++
+			}
+
+			for _, t := range doc.Garbage {
+				eid := []byte(t.ExternalID)
+				owner := tx.Bucket(externalToInternal).Get(eid)
+				live := owner != nil && string(owner) != t.InternalID
+				if bs := tx.Bucket(garbage).Get(eid); live || bs != nil && unmarshalTuple(bs).InternalID != t.InternalID {
+					switch onConflict {
+					case ConflictFail:
+						return errorf("garbage entry from '%s' to '%s' conflicts with the store", t.InternalID, t.ExternalID)
+					case ConflictSkip:
+						skipped++
+						continue
+					}
+					if live {
+						stolen := i.removeExternal(tx, eid, false)
+						i.recordRemoval(tx, stolen)
+						i.emit(tx, EventPurge, stolen)
+					}
+				}
+				importTimes(t, now)
+				i.addToGarbage(tx, t)
+				i.emit(tx, EventGarbage, t)
+				ts = append(ts, t)
+				gbg++
+			}
+
+			for _, r := range doc.References {
+				rk := refKey(r.InternalID, r.ExternalID)
+				if existing := readReference(tx, rk); existing != nil && existing.Era >= r.Era {
+					refs++
+					continue
+				}
+				importTimes(r, now)
+				putInBucket(tx, references, rk, marshalReference(r))
+				ts = append(ts, r)
+				refs++
+			}
+			i.audit(tx, `import`, ts, format, onConflict)
+			onCommit(tx, i.log.Info, "imported", "mappings", mappings, "garbage", gbg, "references", refs, "skipped", skipped)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`mappings`, types.WrapInteger(mappings)),
+		types.WrapHashEntry2(`garbage`, types.WrapInteger(gbg)),
+		types.WrapHashEntry2(`references`, types.WrapInteger(refs)),
+		types.WrapHashEntry2(`skipped`, types.WrapInteger(skipped))})
+}
+
+func (d *document) encode(format string) string {
+	var bs []byte
+	var err error
+	switch format {
+	case `json`:
+		bs, err = json.MarshalIndent(d, ``, `  `)
+	case `yaml`:
+		bs, err = yaml.Marshal(d)
+	default:
+		panic(errorf("unknown document format '%s'. Expected json or yaml", format))
+	}
+	if err != nil {
+		panic(errorf("failed to encode document: %s", err))
+	}
+	return string(bs)
+}
+
+func decodeDocument(data, format string) *document {
+	d := &document{}
+	var err error
+	switch format {
+	case `json`:
+		err = json.Unmarshal([]byte(data), d)
+	case `yaml`:
+		err = yaml.Unmarshal([]byte(data), d)
+	default:
+		panic(errorf("unknown document format '%s'. Expected json or yaml", format))
+	}
+	if err != nil {
+		panic(errorf("failed to decode document: %s", err))
+	}
+
+	v, err := semver.ParseVersion(d.Version)
+	if err != nil {
+		panic(errorf("document has invalid version '%s'", d.Version))
+	}
+	if !supportedVersions.Includes(v) {
+		panic(errorf("document has unsupported data store version. Expected %s, got %s", supportedVersions, d.Version))
+	}
+	for _, ts := range [][]*tuple{d.Mappings, d.Garbage, d.References} {
+		for _, t := range ts {
+			if t == nil || t.InternalID == `` || t.ExternalID == `` {
+				panic(errorf("document contains an entry with an empty internal or external ID"))
+			}
+		}
+	}
+	return d
+}
+
+// renumber gives the records of the document new sequence numbers after the given one in the order of their
+// exported numbers, so that their relative order is kept while the numbers already used by records and history
+// entries of the store are never reused. Records without a number are placed last in document order. Returns the
+// highest number assigned.
+func (d *document) renumber(after int64) int64 {
+	ts := make([]*tuple, 0, len(d.Mappings)+len(d.Garbage)+len(d.References))
+	ts = append(append(append(ts, d.Mappings...), d.Garbage...), d.References...)
+	sort.SliceStable(ts, func(a, b int) bool {
+		sa, sb := ts[a].Seq, ts[b].Seq
+		return sa != 0 && (sb == 0 || sa < sb)
+	})
+	for _, t := range ts {
+		after++
+		t.Seq = after
+	}
+	return after
+}
+
+// importTimes sets the timestamp of an imported tuple to the given time of the import unless the document has one
+// and defaults its association and seen times to its timestamp
+func importTimes(t *tuple, now time.Time) {
+	if t.Timestamp.IsZero() {
+		t.Timestamp = now
+	}
+	t.defaultTimes()
+}
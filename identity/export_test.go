@@ -0,0 +1,183 @@
+package identity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestExportImport.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.AddReference(c, "a:i3", "b:")
+		id.Associate(c, "b:i1", "e3")
+		id.BumpEra(c)
+		id.BumpEra(c)
+		id.RemoveInternal(c, "a:i2")
+
+		for _, format := range []string{"json", "yaml"} {
+			doc := id.Export(c, format)
+
+			copyName := "TestExportImportCopy.db"
+			deleteFile(copyName)
+			cp := NewIdentity(copyName)
+			result := cp.Import(c, doc, format, ConflictFail)
+			require.EqualValues(t, 2, result.Get5("mappings", nil).(px.Integer).Int())
+			require.EqualValues(t, 1, result.Get5("garbage", nil).(px.Integer).Int())
+			require.EqualValues(t, 1, result.Get5("references", nil).(px.Integer).Int())
+			require.EqualValues(t, 0, result.Get5("skipped", nil).(px.Integer).Int())
+
+			require.EqualValues(t, 2, cp.ReadEra(c))
+			require.Equal(t, id.Search(c, "").String(), cp.Search(c, "").String())
+			require.Equal(t, id.Garbage(c, "").String(), cp.Garbage(c, "").String())
+			require.EqualValues(t, 0, cp.Verify(c, false).Len())
+			deleteFile(copyName)
+		}
+	})
+}
+
+func TestImportConflicts(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestImportConflicts.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		doc := `{"version": "1.1.0", "era": 0, "mappings": [
+			{"internalId": "i1", "externalId": "e1"},
+			{"internalId": "i2", "externalId": "e2"}]}`
+
+		id.Associate(c, "i1", "e1")
+		id.Associate(c, "i3", "e2")
+
+		require.Panics(t, func() { id.Import(c, doc, "json", ConflictFail) })
+		checkGetExternal(t, c, id, "i2", "")
+		checkGetInternal(t, c, id, "e2", "i3")
+
+		result := id.Import(c, doc, "json", ConflictSkip)
+		require.EqualValues(t, 1, result.Get5("skipped", nil).(px.Integer).Int())
+		checkGetExternal(t, c, id, "i2", "")
+		checkGetInternal(t, c, id, "e2", "i3")
+
+		result = id.Import(c, doc, "json", ConflictOverwrite)
+		require.EqualValues(t, 2, result.Get5("mappings", nil).(px.Integer).Int())
+		checkGetExternal(t, c, id, "i2", "e2")
+		checkGetExternal(t, c, id, "i3", "")
+		checkGetInternal(t, c, id, "e2", "i2")
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+
+		require.Panics(t, func() { id.Import(c, `{"version": "2.0.0"}`, "json", ConflictFail) })
+		require.Panics(t, func() { id.Import(c, doc, "xml", ConflictFail) })
+		require.Panics(t, func() { id.Import(c, doc, "json", "merge") })
+	})
+}
+
+func TestImportGarbageVerifies(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestImportGarbageVerifies.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		// An imported mapping removes the garbage entry of its external ID
+		id.Associate(c, "a:i1", "e1")
+		id.RemoveInternal(c, "a:i1")
+		id.Import(c, `{"version": "1.1.0", "era": 0, "mappings": [{"internalId": "a:i2", "externalId": "e1"}]}`,
+			"json", ConflictFail)
+		require.EqualValues(t, 0, id.Garbage(c, "").Len())
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+
+		// A garbage entry for an external ID that is mapped from another internal ID is a conflict
+		id.Associate(c, "a:i4", "e2")
+		doc := `{"version": "1.1.0", "era": 0, "garbage": [{"internalId": "a:i3", "externalId": "e2"}]}`
+		require.Panics(t, func() { id.Import(c, doc, "json", ConflictFail) })
+
+		result := id.Import(c, doc, "json", ConflictSkip)
+		require.EqualValues(t, 1, result.Get5("skipped", nil).(px.Integer).Int())
+		require.EqualValues(t, 0, id.Garbage(c, "").Len())
+		checkGetInternal(t, c, id, "e2", "a:i4")
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+
+		result = id.Import(c, doc, "json", ConflictOverwrite)
+		require.EqualValues(t, 1, result.Get5("garbage", nil).(px.Integer).Int())
+		require.EqualValues(t, 1, id.Garbage(c, "a:i3").Len())
+		checkGetExternal(t, c, id, "a:i4", "")
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+	})
+}
+
+func TestImportAfterSequence(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestImportAfterSequence.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		doc := id.Export(c, "json")
+		id.Associate(c, "a:i1", "e2")
+		time.Sleep(2 * time.Millisecond)
+		before := time.Now()
+		time.Sleep(2 * time.Millisecond)
+
+		// The document has sequence 1 which the store has moved past. The imported mapping is appended to the
+		// history instead of replacing its first entry.
+		id.Import(c, doc, "json", ConflictOverwrite)
+		checkGetExternal(t, c, id, "a:i1", "e1")
+		require.Equal(t, []string{`e1`, `e2`, `e1`}, historyIDs(id.History(c, "a:i1")))
+		checkAsOf(t, c, id, "a:i1", before, `e2`)
+		checkAsOf(t, c, id, "a:i1", time.Now(), `e1`)
+
+		tuples := id.Search(c, "a:")
+		require.EqualValues(t, 1, tuples.Len())
+		require.EqualValues(t, 3, tuples.At(0).(px.List).At(4).(px.Integer).Int())
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+	})
+}
+
+func TestImportKeepsOrder(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestImportKeepsOrder.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		// The references are added in the opposite order of their keys. Sweeping z: must reach b: through a:
+		id.AddReference(c, "z:i1", "a:")
+		id.AddReference(c, "a:i1", "b:")
+		id.Associate(c, "z:i2", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.Associate(c, "b:i2", "e3")
+		id.BumpEra(c)
+
+		copyName := "TestImportKeepsOrderCopy.db"
+		deleteFile(copyName)
+		defer deleteFile(copyName)
+		cp := NewIdentity(copyName)
+		cp.Associate(c, "c:i1", "e4")
+		cp.Import(c, id.Export(c, "json"), "json", ConflictFail)
+
+		// The imported records follow the records of the store in their exported order
+		seqs := map[string]int64{}
+		cp.Search(c, "").Each(func(v px.Value) {
+			l := v.(px.List)
+			seqs[l.At(0).String()] = l.At(4).(px.Integer).Int()
+		})
+		require.Equal(t, map[string]int64{"c:i1": 1, "z:i2": 4, "a:i2": 5, "b:i2": 6}, seqs)
+
+		id.Sweep(c, "z:")
+		cp.Sweep(c, "z:")
+		require.Equal(t, 3, id.Garbage(c, "z:").Len())
+		require.Equal(t, tupleIDs(id.Garbage(c, "z:")), tupleIDs(cp.Garbage(c, "z:")))
+		require.EqualValues(t, 0, cp.Verify(c, false).Len())
+	})
+}
@@ -0,0 +1,151 @@
+package identity
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A tupleFilter restricts the tuples returned by a query to a range of GC eras and timestamps
+type tupleFilter struct {
+	minEra *int64
+	maxEra *int64
+	after  time.Time
+	before time.Time
+}
+
+// SearchFiltered finds all tuples that are keyed by an internalID prefixed by internalIDPrefix and that pass the
+// given filter. The filter is a Hash with the optional entries:
+//
+//	minEra  the lowest GC era, inclusive
+//	maxEra  the highest GC era, inclusive
+//	after   the earliest timestamp, inclusive, as a Timestamp or an RFC 3339 String
+//	before  the latest timestamp, exclusive, as a Timestamp or an RFC 3339 String
+//
+// An empty or undefined filter passes all tuples. The tuples are returned in the same form and order as by
+// Search.
+func (i *identity) SearchFiltered(_ px.Context, internalIDPrefix string, filter px.OrderedMap) px.List {
+	f := parseFilter(filter)
+	found := make([]px.Value, 0, 32)
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+				if strings.HasPrefix(string(k), internalIDPrefix) {
+					if t := unmarshalTuple(v); f.matches(t) {
+						found = append(found, t.ValueTuple())
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return sortedValueTuples(found)
+}
+
+// GarbageFiltered finds all tuples in the garbage bin that belong to the workflow with the given prefix and that
+// pass the given filter. The filter is described by SearchFiltered, except that after and before apply to the
+// time when a tuple was moved to the garbage bin. The tuples are returned in the same form and order as by
+// Garbage.
+func (i *identity) GarbageFiltered(_ px.Context, internalIDPrefix string, filter px.OrderedMap) px.List {
+	f := parseFilter(filter)
+	gs := make([]px.Value, 0, 32)
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			era := i.readMetadata(tx).Era
+			prefixes, err := i.buildReferences(tx, era, internalIDPrefix)
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(garbage).ForEach(func(k, v []byte) error {
+				t := unmarshalTuple(v)
+				if !f.matchesGarbage(t) {
+					return nil
+				}
+				for _, pfx := range prefixes {
+					if strings.HasPrefix(t.InternalID, pfx) {
+						gs = append(gs, t.ValueTuple())
+						break
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return sortedValueTuples(gs)
+}
+
+// parseFilter validates the given filter Hash and converts it into a tupleFilter
+func parseFilter(filter px.OrderedMap) *tupleFilter {
+	f := &tupleFilter{}
+	if filter == nil {
+		return f
+	}
+	filter.EachPair(func(k, v px.Value) {
+		switch k.String() {
+		case `minEra`:
+			f.minEra = filterEra(k, v)
+		case `maxEra`:
+			f.maxEra = filterEra(k, v)
+		case `after`:
+			f.after = filterTime(k, v)
+		case `before`:
+			f.before = filterTime(k, v)
+		default:
+			panic(errorf("unknown filter '%s'. Expected minEra, maxEra, after, or before", k))
+		}
+	})
+	return f
+}
+
+func filterEra(k, v px.Value) *int64 {
+	if i, ok := v.(px.Integer); ok {
+		era := i.Int()
+		return &era
+	}
+	panic(errorf("filter '%s' must be an Integer, got %s", k, v.PType()))
+}
+
+func filterTime(k, v px.Value) time.Time {
+	switch v := v.(type) {
+	case *types.Timestamp:
+		return v.Time()
+	case px.StringValue:
+		if t, err := time.Parse(time.RFC3339Nano, v.String()); err == nil {
+			return t
+		}
+	}
+	panic(errorf("filter '%s' must be a Timestamp or an RFC 3339 String, got '%s'", k, v))
+}
+
+// matches returns true if the tuple passes the filter
+func (f *tupleFilter) matches(t *tuple) bool {
+	switch {
+	case f.minEra != nil && t.Era < *f.minEra:
+	case f.maxEra != nil && t.Era > *f.maxEra:
+	case !f.after.IsZero() && t.Timestamp.Before(f.after):
+	case !f.before.IsZero() && !t.Timestamp.Before(f.before):
+	default:
+		return true
+	}
+	return false
+}
+
+// matchesGarbage returns true if the garbage tuple passes the filter. The time range applies to when the tuple was
+// moved to the garbage bin.
+func (f *tupleFilter) matchesGarbage(t *tuple) bool {
+	c := *t
+	if t.Collected != nil {
+		c.Timestamp = *t.Collected
+	}
+	return f.matches(&c)
+}
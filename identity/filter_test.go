@@ -0,0 +1,107 @@
+package identity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/stretchr/testify/require"
+)
+
+func filterHash(entries map[string]px.Value) px.OrderedMap {
+	es := make([]*types.HashEntry, 0, len(entries))
+	for k, v := range entries {
+		es = append(es, types.WrapHashEntry2(k, v))
+	}
+	return types.WrapHash(es)
+}
+
+func TestSearchFiltered(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSearchFiltered.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.BumpEra(c)
+		id.Associate(c, "a:i2", "e2")
+		time.Sleep(5 * time.Millisecond)
+		mid := time.Now()
+		id.BumpEra(c)
+		id.Associate(c, "a:i3", "e3")
+
+		require.Equal(t, []string{"a:i1", "a:i2", "a:i3"}, tupleIDs(id.SearchFiltered(c, "a:", nil)))
+		require.Equal(t, []string{"a:i2", "a:i3"}, tupleIDs(id.SearchFiltered(c, "a:",
+			filterHash(map[string]px.Value{`minEra`: types.WrapInteger(1)}))))
+		require.Equal(t, []string{"a:i1", "a:i2"}, tupleIDs(id.SearchFiltered(c, "a:",
+			filterHash(map[string]px.Value{`maxEra`: types.WrapInteger(1)}))))
+		require.Equal(t, []string{"a:i3"}, tupleIDs(id.SearchFiltered(c, "a:",
+			filterHash(map[string]px.Value{`after`: types.WrapTimestamp(mid)}))))
+		require.Equal(t, []string{"a:i1", "a:i2"}, tupleIDs(id.SearchFiltered(c, "a:",
+			filterHash(map[string]px.Value{`before`: types.WrapString(mid.Format(time.RFC3339Nano))}))))
+
+		ids, next := pageIDs(id.SearchPage(c, "a:", filterHash(map[string]px.Value{`minEra`: types.WrapInteger(1)}), 1, ``))
+		require.Equal(t, []string{"a:i2"}, ids)
+		ids, next = pageIDs(id.SearchPage(c, "a:", filterHash(map[string]px.Value{`minEra`: types.WrapInteger(1)}), 1, next))
+		require.Equal(t, []string{"a:i3"}, ids)
+		require.Equal(t, ``, next)
+
+		require.Panics(t, func() { id.SearchFiltered(c, "a:", filterHash(map[string]px.Value{`era`: types.WrapInteger(1)})) })
+		require.Panics(t, func() { id.SearchFiltered(c, "a:", filterHash(map[string]px.Value{`minEra`: types.WrapString(`1`)})) })
+		require.Panics(t, func() {
+			id.SearchFiltered(c, "a:", filterHash(map[string]px.Value{`after`: types.WrapString(`yesterday`)}))
+		})
+	})
+}
+
+func TestGarbageFiltered(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestGarbageFiltered.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.RemoveInternal(c, "a:i1")
+		id.BumpEra(c)
+		id.Associate(c, "a:i3", "e3")
+		id.RemoveInternal(c, "a:i3")
+
+		f := filterHash(map[string]px.Value{`minEra`: types.WrapInteger(1)})
+		require.Equal(t, []string{"a:i3"}, tupleIDs(id.GarbageFiltered(c, "a:", f)))
+		ids, _ := pageIDs(id.GarbagePage(c, "a:", f, 10, ``))
+		require.Equal(t, []string{"a:i3"}, ids)
+		require.Equal(t, 2, id.GarbageFiltered(c, "a:", nil).Len())
+	})
+}
+
+func TestGarbageFilteredByCollection(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestGarbageFilteredByCollection.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		time.Sleep(10 * time.Millisecond)
+		collected := time.Now()
+		id.RemoveInternal(c, "a:i1")
+
+		// a:i1 was created before the time but moved to the garbage bin after it
+		after := filterHash(map[string]px.Value{`after`: types.WrapTimestamp(collected)})
+		require.Equal(t, []string{"a:i1"}, tupleIDs(id.GarbageFiltered(c, "a:", after)))
+		ids, _ := pageIDs(id.GarbagePage(c, "a:", after, 10, ``))
+		require.Equal(t, []string{"a:i1"}, ids)
+		require.Equal(t, 0, id.SearchFiltered(c, "a:", after).Len())
+
+		before := filterHash(map[string]px.Value{`before`: types.WrapTimestamp(collected)})
+		require.Equal(t, 0, id.GarbageFiltered(c, "a:", before).Len())
+		ids, _ = pageIDs(id.GarbagePage(c, "a:", before, 10, ``))
+		require.Empty(t, ids)
+	})
+}
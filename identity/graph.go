@@ -0,0 +1,125 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A graphEdge represents one reference between two workflows
+type graphEdge struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Via       string    `json:"via"`
+	Era       int64     `json:"era"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// A referenceGraph is the call graph stored in the references bucket. The nodes are internal ID prefixes
+type referenceGraph struct {
+	Nodes []string     `json:"nodes"`
+	Edges []*graphEdge `json:"edges"`
+}
+
+// ReferenceGraph returns the graph of references that extends from internalIDPrefix, directly or transitively,
+// regardless of the GC era of the references. An empty prefix yields the graph of all references.
+//
+// The nodes of the graph are internal ID prefixes. A reference is drawn as an edge from the most specific
+// known prefix of the referencing internal ID to the referenced prefix and labelled with its era and timestamp.
+//
+// The format must be either "dot" (Graphviz) or "json"
+func (i *identity) ReferenceGraph(_ px.Context, internalIDPrefix, format string) (result string) {
+	var g *referenceGraph
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			refs, err := readReferences(tx, func(*reference) bool { return true })
+			if err == nil {
+				g = buildGraph(reachableReferences(refs, internalIDPrefix), internalIDPrefix)
+			}
+			return err
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	switch format {
+	case `dot`:
+		result = g.dot()
+	case `json`:
+		result = g.json()
+	default:
+		panic(errorf("unknown graph format '%s'. Expected dot or json", format))
+	}
+	return
+}
+
+func buildGraph(refs []*reference, internalIDPrefix string) *referenceGraph {
+	known := make(map[string]bool, len(refs)+1)
+	if internalIDPrefix != `` {
+		known[internalIDPrefix] = true
+	}
+	for _, ref := range refs {
+		known[ref.ExternalID] = true
+	}
+
+	nodes := make(map[string]bool, len(known))
+	for n := range known {
+		nodes[n] = true
+	}
+
+	g := &referenceGraph{Edges: make([]*graphEdge, 0, len(refs))}
+	for _, ref := range refs {
+		from := ownerPrefix(known, ref.InternalID)
+		nodes[from] = true
+		g.Edges = append(g.Edges, &graphEdge{From: from, To: ref.ExternalID, Via: ref.InternalID, Era: ref.Era, Timestamp: ref.Timestamp})
+	}
+	g.Nodes = make([]string, 0, len(nodes))
+	for n := range nodes {
+		g.Nodes = append(g.Nodes, n)
+	}
+	sort.Strings(g.Nodes)
+	return g
+}
+
+// ownerPrefix returns the longest of the known prefixes that is a prefix of internalID, or the internalID
+// itself when no such prefix exists
+func ownerPrefix(known map[string]bool, internalID string) string {
+	owner := ``
+	for pfx := range known {
+		if len(pfx) > len(owner) && strings.HasPrefix(internalID, pfx) {
+			owner = pfx
+		}
+	}
+	if owner == `` {
+		owner = internalID
+	}
+	return owner
+}
+
+func (g *referenceGraph) dot() string {
+	b := bytes.NewBufferString("digraph references {\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(b, "  %q;\n", n)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(b, "  %q -> %q [label=%q];\n", e.From, e.To,
+			fmt.Sprintf("%s\nera %d\n%s", e.Via, e.Era, e.Timestamp.Format(time.RFC3339)))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (g *referenceGraph) json() string {
+	bs, err := json.MarshalIndent(g, ``, `  `)
+	if err != nil {
+		panic(errorf("failed to encode reference graph: %s", err))
+	}
+	return string(bs)
+}
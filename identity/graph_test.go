@@ -0,0 +1,47 @@
+package identity
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferenceGraph(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestReferenceGraph.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.AddReference(c, "a:i2", "b:")
+		id.AddReference(c, "b:i1", "c:")
+		id.AddReference(c, "x:i1", "y:")
+
+		g := &referenceGraph{}
+		require.NoError(t, json.Unmarshal([]byte(id.ReferenceGraph(c, "a:", "json")), g))
+		require.Equal(t, []string{"a:", "b:", "c:"}, g.Nodes)
+		require.Equal(t, 2, len(g.Edges))
+		require.Equal(t, "a:", g.Edges[0].From)
+		require.Equal(t, "b:", g.Edges[0].To)
+		require.Equal(t, "a:i2", g.Edges[0].Via)
+		require.Equal(t, "b:", g.Edges[1].From)
+		require.Equal(t, "c:", g.Edges[1].To)
+
+		// Empty prefix yields all references
+		require.NoError(t, json.Unmarshal([]byte(id.ReferenceGraph(c, "", "json")), g))
+		require.Equal(t, 3, len(g.Edges))
+		require.Equal(t, "x:i1", g.Edges[2].From)
+
+		dot := id.ReferenceGraph(c, "a:", "dot")
+		require.True(t, strings.HasPrefix(dot, "digraph references {\n"))
+		require.Contains(t, dot, `"a:" -> "b:"`)
+		require.Contains(t, dot, `"b:" -> "c:"`)
+
+		require.Panics(t, func() { id.ReferenceGraph(c, "a:", "svg") })
+	})
+}
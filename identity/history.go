@@ -0,0 +1,119 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// History returns the history of the mappings of the given internal ID in the order the changes were made.
+//
+// Each entry is a seven element array as described for ValueTuple. The Timestamp of an entry is when the change
+// was made and the ExternalID is the external ID that the internal ID was associated with, or an empty string
+// when the internal ID lost its mapping. Entries are kept when mappings are replaced, removed, or purged. An
+// empty slice is returned when the internal ID has never been associated.
+func (i *identity) History(_ px.Context, internalID string) px.List {
+	found := make([]px.Value, 0, 8)
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			eachHistory(tx, internalID, func(t *tuple) {
+				found = append(found, t.ValueTuple())
+			})
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return types.WrapValues(found)
+}
+
+// GetExternalAsOf returns the external ID that the given internal ID was associated with at the given time, or
+// an empty string if no association existed at that time. The GC-era of the mapping is not updated.
+func (i *identity) GetExternalAsOf(_ px.Context, internalID string, at time.Time) (externalID string, found bool) {
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			var hs []*tuple
+			eachHistory(tx, internalID, func(t *tuple) {
+				if !t.Timestamp.After(at) {
+					hs = append(hs, t)
+				}
+			})
+			if len(hs) > 0 {
+				// The latest change at or before the given time wins. Changes made at the same time are
+				// ordered by sequence number
+				sort.SliceStable(hs, func(a, b int) bool { return hs[a].Timestamp.Before(hs[b].Timestamp) })
+				externalID = hs[len(hs)-1].ExternalID
+				found = externalID != ``
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return
+}
+
+// eachHistory calls f with each history entry of the given internal ID in sequence order
+func eachHistory(tx *bolt.Tx, internalID string, f func(t *tuple)) {
+	prefix := historyPrefix(internalID)
+	c := tx.Bucket(history).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) == len(prefix)+8 {
+			f(unmarshalTuple(v))
+		}
+	}
+}
+
+func historyPrefix(internalID string) []byte {
+	return []byte(internalID + "\x00")
+}
+
+// historyKey returns the key of a history entry. The entries of an internal ID are adjacent and ordered by
+// sequence number
+func historyKey(internalID string, seq int64) []byte {
+	k := make([]byte, len(internalID)+9)
+	copy(k, internalID)
+	binary.BigEndian.PutUint64(k[len(internalID)+1:], uint64(seq))
+	return k
+}
+
+// recordHistory appends an entry to the history of the internal ID of the given tuple that records that it
+// became associated with the external ID of the tuple when the tuple was created
+func recordHistory(tx *bolt.Tx, t *tuple) {
+	h := &tuple{InternalID: t.InternalID, ExternalID: t.ExternalID, Timestamp: t.Timestamp, Era: t.Era, Seq: t.Seq,
+		Associated: t.Timestamp, Seen: t.Timestamp}
+	putInBucket(tx, history, historyKey(t.InternalID, t.Seq), marshalTuple(h))
+}
+
+// recordRemoval appends an entry to the history of the internal ID of the given tuple that records that it lost
+// its mapping
+func (i *identity) recordRemoval(tx *bolt.Tx, t *tuple) {
+	if t != nil {
+		now := time.Now()
+		recordHistory(tx, &tuple{InternalID: t.InternalID, Timestamp: now, Era: i.readMetadata(tx).Era, Seq: i.nextSeq(tx)})
+	}
+}
+
+// createHistory creates the history bucket and records the association of each mapping in the store. Used when
+// upgrading a store to version 1.4.0
+func createHistory(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(history); err != nil {
+		return err
+	}
+	var ts []*tuple
+	err := tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+		ts = append(ts, unmarshalTuple(v))
+		return nil
+	})
+	for _, t := range ts {
+		recordHistory(tx, t)
+	}
+	return err
+}
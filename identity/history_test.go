@@ -0,0 +1,113 @@
+package identity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func historyIDs(h px.List) []string {
+	ids := make([]string, h.Len())
+	h.EachWithIndex(func(t px.Value, ix int) { ids[ix] = t.(px.List).At(1).String() })
+	return ids
+}
+
+func checkAsOf(t *testing.T, c px.Context, id Service, internalID string, at time.Time, expected string) {
+	t.Helper()
+	eid, found := id.GetExternalAsOf(c, internalID, at)
+	require.Equal(t, expected != ``, found)
+	require.Equal(t, expected, eid)
+}
+
+func TestHistory(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestHistory.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		before := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		id.Associate(c, "a:i1", "e1")
+		time.Sleep(2 * time.Millisecond)
+		t1 := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		id.Associate(c, "a:i1", "e2")
+		id.Associate(c, "a:i1", "e2")
+		time.Sleep(2 * time.Millisecond)
+		t2 := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		id.RemoveInternal(c, "a:i1")
+		time.Sleep(2 * time.Millisecond)
+		t3 := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		id.Associate(c, "a:i1", "e3")
+
+		// Re-association of an identical mapping is not a change
+		require.Equal(t, []string{`e1`, `e2`, ``, `e3`}, historyIDs(id.History(c, "a:i1")))
+		require.EqualValues(t, 0, id.History(c, "a:i2").Len())
+
+		checkAsOf(t, c, id, "a:i1", before, ``)
+		checkAsOf(t, c, id, "a:i1", t1, `e1`)
+		checkAsOf(t, c, id, "a:i1", t2, `e2`)
+		checkAsOf(t, c, id, "a:i1", t3, ``)
+		checkAsOf(t, c, id, "a:i1", time.Now(), `e3`)
+
+		// The history survives a purge
+		id.PurgeInternal(c, "a:i1")
+		require.Equal(t, []string{`e1`, `e2`, ``, `e3`, ``}, historyIDs(id.History(c, "a:i1")))
+		checkAsOf(t, c, id, "a:i1", t2, `e2`)
+	})
+}
+
+func TestHistoryOfStolenExternal(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestHistoryOfStolenExternal.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e1")
+		require.Equal(t, []string{`e1`, ``}, historyIDs(id.History(c, "a:i1")))
+		require.Equal(t, []string{`e1`}, historyIDs(id.History(c, "a:i2")))
+		checkAsOf(t, c, id, "a:i1", time.Now(), ``)
+
+		// History does not include entries of internal IDs that start with the given one
+		id.Associate(c, "a:i", "e2")
+		require.Equal(t, []string{`e2`}, historyIDs(id.History(c, "a:i")))
+	})
+}
+
+func TestHistoryMigration(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestHistoryMigration.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		created := time.Now().Add(-time.Hour)
+		corrupt(filename, func(tx *bolt.Tx) error {
+			for _, bn := range [][]byte{metadata, internalToExternal, externalToInternal, garbage, references} {
+				if _, err := tx.CreateBucket(bn); err != nil {
+					return err
+				}
+			}
+			putInBucket(tx, metadata, metadata, marshalMetadata(&storeMeta{Version: `1.3.0`, Timestamp: created, Seq: 1}))
+			putInBucket(tx, internalToExternal, []byte(`a:i1`), marshalTuple(&tuple{InternalID: `a:i1`, ExternalID: `e1`,
+				Timestamp: created, Seq: 1, Associated: created, Seen: created}))
+			putInBucket(tx, externalToInternal, []byte(`e1`), []byte(`a:i1`))
+			return nil
+		})
+
+		id := NewIdentity(filename)
+		require.Equal(t, []string{`e1`}, historyIDs(id.History(c, "a:i1")))
+		checkAsOf(t, c, id, "a:i1", created, `e1`)
+		checkAsOf(t, c, id, "a:i1", created.Add(-time.Second), ``)
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+		require.Contains(t, id.Export(c, `json`), `"version": "`+identityStoreVersion.String()+`"`)
+	})
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/lyraproj/pcore/pcore"
 	"github.com/lyraproj/pcore/px"
 	"github.com/lyraproj/pcore/types"
@@ -21,18 +23,133 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
+// Service is the Go API of the Identity service. It extends serviceapi.Identity with the operations that
+// are specific to this Bolt based implementation.
+type Service interface {
+	serviceapi.Identity
+
+	// ReadEra returns the current GC-era
+	ReadEra(ctx px.Context) int64
+
+	// ReferenceGraph returns the graph of references that extends from internalIDPrefix in the given
+	// format, which must be either "dot" or "json"
+	ReferenceGraph(ctx px.Context, internalIDPrefix, format string) string
+
+	// TeardownPlan returns the tuples of a workflow and its sub-workflows in the order they should be deleted
+	TeardownPlan(ctx px.Context, internalIDPrefix string) px.List
+
+	// ExplainGC explains whether a Sweep of sweepPrefix would move the tuple keyed by internalID to the garbage bin
+	ExplainGC(ctx px.Context, internalID, sweepPrefix string) px.OrderedMap
+
+	// SearchReferenced finds the tuples of a workflow and of the workflows that it references, each annotated
+	// with the prefix that brought it in
+	SearchReferenced(ctx px.Context, internalIDPrefix string) px.List
+
+	// OrphanReferences finds, and optionally purges, references whose target workflow no longer has mappings
+	OrphanReferences(ctx px.Context, purge bool) px.List
+
+	// Verify checks the consistency of the store and optionally repairs the problems that it finds
+	Verify(ctx px.Context, repair bool) px.List
+
+	// Export returns all mappings, garbage, references, and metadata of the store as a JSON or YAML document
+	Export(ctx px.Context, format string) string
+
+	// Import loads a document produced by Export into the store
+	Import(ctx px.Context, document, format, onConflict string) px.OrderedMap
+
+	// Backup writes a consistent snapshot of the store to the file at the given path
+	Backup(ctx px.Context, path string)
+
+	// Restore replaces the store with a snapshot written by Backup
+	Restore(ctx px.Context, path string)
+
+	// Compact rewrites the store into a fresh file and returns its size before and after
+	Compact(ctx px.Context) px.OrderedMap
+
+	// Stats returns statistics about the tuples and references of a workflow and about the store file
+	Stats(ctx px.Context, internalIDPrefix string) px.OrderedMap
+
+	// SearchPage returns one page of the tuples found by SearchFiltered along with a token for the next page
+	SearchPage(ctx px.Context, internalIDPrefix string, filter px.OrderedMap, limit int64, token string) px.OrderedMap
+
+	// GarbagePage returns one page of the tuples found by GarbageFiltered along with a token for the next page
+	GarbagePage(ctx px.Context, internalIDPrefix string, filter px.OrderedMap, limit int64, token string) px.OrderedMap
+
+	// SearchExternal finds all tuples whose externalID is prefixed by externalIDPrefix
+	SearchExternal(ctx px.Context, externalIDPrefix string) px.List
+
+	// SearchMatching finds all tuples where the internal or external ID matches a prefix, glob, or regex
+	SearchMatching(ctx px.Context, field, mode, pattern string) px.List
+
+	// SearchFiltered is like Search but only returns the tuples that pass the given era and timestamp filter
+	SearchFiltered(ctx px.Context, internalIDPrefix string, filter px.OrderedMap) px.List
+
+	// GarbageFiltered is like Garbage but only returns the tuples that pass the given era and timestamp filter
+	GarbageFiltered(ctx px.Context, internalIDPrefix string, filter px.OrderedMap) px.List
+
+	// PeekExternal is like GetExternal but does not update the GC-era of the mapping
+	PeekExternal(ctx px.Context, internalID string) (string, bool)
+
+	// PeekInternal is like GetInternal but does not update the GC-era of the mapping
+	PeekInternal(ctx px.Context, externalID string) (string, bool)
+
+	// History returns the external IDs that the given internal ID has been associated with over time
+	History(ctx px.Context, internalID string) px.List
+
+	// GetExternalAsOf returns the external ID that the given internal ID was associated with at the given time
+	GetExternalAsOf(ctx px.Context, internalID string, at time.Time) (string, bool)
+
+	// Audit returns the records of the audit log of the store, which has a record for every change made
+	Audit(ctx px.Context, internalIDPrefix string, filter px.OrderedMap) px.List
+
+	// RotateAudit moves the records of the audit log that are older than the given time to a JSON-lines file
+	RotateAudit(ctx px.Context, path string, before time.Time) int64
+
+	// Watch waits up to wait milliseconds for changes to mappings with the given prefix that follow the token
+	Watch(ctx px.Context, internalIDPrefix, token string, wait int64) px.OrderedMap
+
+	// StreamAddress returns the address to pass to DialStream, or an empty string when the streaming methods
+	// are not served
+	StreamAddress(ctx px.Context) string
+}
+
 // Identity stores identity state
 type identity struct {
 	filename string
-	lock     sync.Mutex
+	options  *Options
+	log      hclog.Logger
+
+	// streamAddress is the address of the socket of the streaming methods while the service is served
+	streamAddress string
+
+	// lock is held for reading while a request uses the store and for writing while the store file is replaced
+	lock sync.RWMutex
+
+	// db is the Bolt database shared by the requests that use the store concurrently. It is opened by the first
+	// of them and closed by the last one so that the file lock is only held while requests are served. Guarded
+	// by dbLock
+	db     *bolt.DB
+	users  int
+	dbLock sync.Mutex
+
+	// changed is closed when a change is committed. Guarded by changeLock
+	changed    chan struct{}
+	changeLock sync.Mutex
 }
 
-// A tuple represents an external ID with timestamp and GC status
+// A tuple represents an external ID with GC status, the sequence number that orders it among all tuples and
+// references of the store, and three timestamps. Timestamp is when the tuple was created, Associated is when
+// the association was last made, and Seen is when the era of the tuple was last raised or it was re-associated.
+// Collected is when the tuple was moved to the garbage bin and is only set for garbage.
 type tuple struct {
-	InternalID string
-	ExternalID string
-	Timestamp  time.Time
-	Era        int64
+	InternalID string     `json:"internalId" yaml:"internalId"`
+	ExternalID string     `json:"externalId" yaml:"externalId"`
+	Timestamp  time.Time  `json:"timestamp" yaml:"timestamp"`
+	Era        int64      `json:"era" yaml:"era"`
+	Seq        int64      `json:"seq" yaml:"seq"`
+	Associated time.Time  `json:"associated" yaml:"associated"`
+	Seen       time.Time  `json:"seen" yaml:"seen"`
+	Collected  *time.Time `json:"collected,omitempty" yaml:"collected,omitempty"`
 }
 
 // A reference represents a mapping between two internal IDs. It is used
@@ -43,6 +160,7 @@ type storeMeta struct {
 	Version   string
 	Timestamp time.Time
 	Era       int64
+	Seq       int64
 }
 
 // error used internally by the identity service
@@ -61,44 +179,106 @@ var internalToExternal = []byte("internalToExternal")
 var externalToInternal = []byte("externalToInternal")
 var references = []byte("references")
 var garbage = []byte("garbage")
+var history = []byte("history")
+var audit = []byte("audit")
+var events = []byte("events")
 
-var identityStoreVersion = semver.MustParseVersion("1.1.0")
+var identityStoreVersion = semver.MustParseVersion("1.7.0")
 var supportedVersions = semver.MustParseVersionRange("1.x")
 
 // Start the Identity service running
 func Start(filename string) {
+	o := DefaultOptions()
+	o.DB = filename
+	StartWithOptions(o)
+}
+
+// StartWithOptions starts the Identity service running using the given options
+func StartWithOptions(o *Options) {
 	pcore.Do(func(c px.Context) {
-		sb := service.NewServiceBuilder(c, "Identity")
-		id := NewIdentity(filename)
-		sb.RegisterAPI("Identity::Service", id)
-		s := sb.Server()
-		grpc.Serve(c, s)
+		Serve(c, o)
 	})
 }
 
-// ValueTuple creates a four element Array consisting of InternalID, ExternalID, Timestamp, and GCEra.
+// Serve runs the Identity service using the given context and options. The process is recorded as the owner
+// of the store while the service runs.
+func Serve(c px.Context, o *Options) {
+	sb := service.NewServiceBuilder(c, "Identity")
+	id := NewIdentityWithOptions(o).(*identity)
+	if err := writeOwner(id.filename, id.options.FileMode); err != nil {
+		panic(err)
+	}
+	defer removeOwner(id.filename)
+	id.log.Info("starting identity service", "db", id.filename, "pid", os.Getpid())
+	stop, err := serveStream(c, id)
+	if err != nil {
+		panic(err)
+	}
+	defer stop()
+	sb.RegisterAPI("Identity::Service", id)
+	grpc.Serve(c, sb.Server())
+}
+
+// StreamAddress returns the address of the unix socket on which the streaming methods of the service are served
+func (i *identity) StreamAddress(_ px.Context) string {
+	return i.streamAddress
+}
+
+// ValueTuple creates a seven element Array consisting of InternalID, ExternalID, Timestamp, GCEra, Seq,
+// Associated, and Seen.
 //
-// The Pcore type of the tuple is Tuple[String, String, Timestamp, Integer]
+// The Pcore type of the tuple is Tuple[String, String, Timestamp, Integer, Integer, Timestamp, Timestamp]
 func (t *tuple) ValueTuple() px.List {
 	return types.WrapValues([]px.Value{
 		types.WrapString(t.InternalID),
 		types.WrapString(t.ExternalID),
 		types.WrapTimestamp(t.Timestamp),
-		types.WrapInteger(t.Era)})
+		types.WrapInteger(t.Era),
+		types.WrapInteger(t.Seq),
+		types.WrapTimestamp(t.Associated),
+		types.WrapTimestamp(t.Seen)})
 }
 
 // NewIdentity opens the database
-func NewIdentity(filename string) serviceapi.Identity {
-	absName, err := filepath.Abs(filename)
+func NewIdentity(filename string) Service {
+	o := DefaultOptions()
+	o.DB = filename
+	return NewIdentityWithOptions(o)
+}
+
+// NewIdentityWithOptions creates a new identity service for the store described by the given options. The
+// options are validated before the store is opened.
+func NewIdentityWithOptions(o *Options) Service {
+	if err := o.Validate(); err != nil {
+		panic(err)
+	}
+	i := newIdentity(o)
+	i.initialize()
+	return i
+}
+
+// newIdentity creates an identity for the store described by the given options without opening it
+func newIdentity(o *Options) *identity {
+	absName, err := filepath.Abs(o.DB)
 	if err != nil {
 		panic(err)
 	}
-	i := &identity{
-		filename: absName,
+	log := o.Logger
+	if log == nil {
+		lo := *hclog.DefaultOptions
+		lo.Level = hclog.LevelFromString(o.LogLevel)
+		log = hclog.New(&lo)
 	}
+	return &identity{filename: absName, options: o, log: log}
+}
+
+// initialize ensures that the store has a supported version, upgrades it if necessary, and creates
+// the buckets of a new store
+func (i *identity) initialize() {
 	i.withDb(func(db *bolt.DB) {
 		// Ensure that buckets exist
 		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
 			mbb := tx.Bucket(metadata)
 			if mbb != nil {
 				mb := mbb.Get(metadata)
@@ -106,6 +286,7 @@ func NewIdentity(filename string) serviceapi.Identity {
 					return fmt.Errorf("identity store at '%s' has invalid format", i.filename)
 				}
 				md := unmarshalMetadata(mb)
+				from := md.Version
 				v := semver.MustParseVersion(md.Version)
 				if !supportedVersions.Includes(v) {
 					return fmt.Errorf("identity store at '%s' has unsupported data store version. Expected %s, got %s", i.filename, supportedVersions, md.Version)
@@ -118,6 +299,51 @@ func NewIdentity(filename string) serviceapi.Identity {
 						err = mbb.Put(metadata, marshalMetadata(md))
 					}
 				}
+				if err == nil && md.Version == `1.1.0` {
+					// Upgrade storage to 1.2.0
+					if md.Seq, err = assignSequences(tx); err == nil {
+						md.Version = `1.2.0`
+						err = mbb.Put(metadata, marshalMetadata(md))
+					}
+				}
+				if err == nil && md.Version == `1.2.0` {
+					// Upgrade storage to 1.3.0
+					if err = assignTimes(tx); err == nil {
+						md.Version = `1.3.0`
+						err = mbb.Put(metadata, marshalMetadata(md))
+					}
+				}
+				if err == nil && md.Version == `1.3.0` {
+					// Upgrade storage to 1.4.0
+					if err = createHistory(tx); err == nil {
+						md.Version = `1.4.0`
+						err = mbb.Put(metadata, marshalMetadata(md))
+					}
+				}
+				if err == nil && md.Version == `1.4.0` {
+					// Upgrade storage to 1.5.0
+					if _, err = tx.CreateBucketIfNotExists(audit); err == nil {
+						md.Version = `1.5.0`
+						err = mbb.Put(metadata, marshalMetadata(md))
+					}
+				}
+				if err == nil && md.Version == `1.5.0` {
+					// Upgrade storage to 1.6.0
+					if _, err = tx.CreateBucketIfNotExists(events); err == nil {
+						md.Version = `1.6.0`
+						err = mbb.Put(metadata, marshalMetadata(md))
+					}
+				}
+				if err == nil && md.Version == `1.6.0` {
+					// Upgrade storage to 1.7.0
+					if err = assignCollected(tx); err == nil {
+						md.Version = `1.7.0`
+						err = mbb.Put(metadata, marshalMetadata(md))
+					}
+				}
+				if err == nil && md.Version != from {
+					onCommit(tx, i.log.Info, "upgraded identity store", "db", i.filename, "from", from, "to", md.Version)
+				}
 				return err
 			}
 
@@ -130,26 +356,21 @@ func NewIdentity(filename string) serviceapi.Identity {
 			mbb, err = tx.CreateBucket(metadata)
 			if err == nil {
 				err = mbb.Put(metadata, mb)
-				if err == nil {
-					_, err = tx.CreateBucket(internalToExternal)
+				for _, bn := range allBuckets[1:] {
 					if err == nil {
-						_, err = tx.CreateBucket(externalToInternal)
-						if err == nil {
-							_, err = tx.CreateBucket(garbage)
-							if err == nil {
-								_, err = tx.CreateBucket(references)
-							}
-						}
+						_, err = tx.CreateBucket(bn)
 					}
 				}
 			}
+			if err == nil {
+				onCommit(tx, i.log.Info, "created identity store", "db", i.filename, "version", identityStoreVersion.String())
+			}
 			return err
 		})
 		if err != nil {
 			panic(err)
 		}
 	})
-	return i
 }
 
 // BumpEra bumps the current GC-era
@@ -159,6 +380,9 @@ func (i *identity) BumpEra(_ px.Context) {
 			md := i.readMetadata(tx)
 			md.Era++
 			putInBucket(tx, metadata, metadata, marshalMetadata(md))
+			i.audit(tx, `bumpEra`, nil)
+			i.emit(tx, EventBumpEra, nil)
+			onCommit(tx, i.log.Info, "bumped era", "era", md.Era)
 			return nil
 		})
 		if err != nil {
@@ -192,24 +416,49 @@ func (i *identity) Associate(_ px.Context, internalID, externalID string) {
 			iid := []byte(internalID)
 			eid := []byte(externalID)
 
-			// Remove external mapping from garbage bin if present
-			deleteFromBucket(tx, garbage, eid)
-
+			var replaced *tuple
 			if t := readTuple(tx, iid); t != nil {
 				if t.ExternalID == externalID {
-					// Mapping already present. Just update era
-					i.updateEra(t, tx)
+					// Mapping already present. Remove it from garbage bin if present and update era and times
+					deleteFromBucket(tx, garbage, eid)
+					now := time.Now()
+					t.Era = i.readMetadata(tx).Era
+					t.Associated = now
+					t.Seen = now
+					putInBucket(tx, internalToExternal, iid, marshalTuple(t))
+					i.audit(tx, `associate`, affected(t), internalID, externalID)
+					onCommit(tx, i.log.Trace, "refreshed mapping", "internalId", internalID, "externalId", externalID, "era", t.Era)
 					return nil
 				}
-				i.removeInternal(tx, iid, true)
+				// The new mapping replaces this one in the history of the internal ID
+				replaced = i.removeInternal(tx, iid, true)
+			}
+			stolen := i.removeExternal(tx, eid, true)
+			i.recordRemoval(tx, stolen)
+			i.emit(tx, EventRemove, replaced)
+			i.emit(tx, EventRemove, stolen)
+			if replaced != nil {
+				onCommit(tx, i.log.Debug, "replaced mapping", "internalId", internalID, "externalId", replaced.ExternalID, "newExternalId", externalID)
+			}
+			if stolen != nil {
+				onCommit(tx, i.log.Debug, "replaced mapping", "internalId", stolen.InternalID, "externalId", externalID, "newInternalId", internalID)
 			}
-			i.removeExternal(tx, eid, true)
+
+			// Remove external mapping from garbage bin if present. This must be done after the removals
+			// since they might move a previous mapping of the external ID to the garbage bin
+			deleteFromBucket(tx, garbage, eid)
 
 			// Add the mapping in both directions
 			m := i.readMetadata(tx)
-			b := marshalTuple(&tuple{InternalID: internalID, ExternalID: externalID, Timestamp: time.Now(), Era: m.Era})
-			putInBucket(tx, internalToExternal, iid, b)
+			now := time.Now()
+			t := &tuple{InternalID: internalID, ExternalID: externalID, Timestamp: now, Era: m.Era, Seq: i.nextSeq(tx),
+				Associated: now, Seen: now}
+			putInBucket(tx, internalToExternal, iid, marshalTuple(t))
 			putInBucket(tx, externalToInternal, eid, iid)
+			recordHistory(tx, t)
+			i.audit(tx, `associate`, affected(replaced, stolen, t), internalID, externalID)
+			i.emit(tx, EventAssociate, t)
+			onCommit(tx, i.log.Debug, "associated", "internalId", internalID, "externalId", externalID, "era", t.Era)
 			return nil
 		})
 		if err != nil {
@@ -226,14 +475,19 @@ func (i *identity) AddReference(_ px.Context, internalId, otherId string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
 			refKey := refKey(internalId, otherId)
-			if t := readReference(tx, refKey); t != nil {
-				// Mapping already present. Just update era
-				i.updateEra(t, tx)
+			if r := readReference(tx, refKey); r != nil {
+				// Reference already present. Just update era
+				i.updateReferenceEra(r, tx)
+				i.audit(tx, `addReference`, affected(r), internalId, otherId)
 				return nil
 			}
 			m := i.readMetadata(tx)
-			r := marshalReference(&reference{InternalID: internalId, ExternalID: otherId, Timestamp: time.Now(), Era: m.Era})
-			putInBucket(tx, references, refKey, r)
+			now := time.Now()
+			r := &reference{InternalID: internalId, ExternalID: otherId, Timestamp: now, Era: m.Era, Seq: i.nextSeq(tx),
+				Associated: now, Seen: now}
+			putInBucket(tx, references, refKey, marshalReference(r))
+			i.audit(tx, `addReference`, affected(r), internalId, otherId)
+			onCommit(tx, i.log.Debug, "added reference", "internalId", internalId, "prefix", otherId, "era", r.Era)
 			return nil
 		})
 		if err != nil {
@@ -286,14 +540,59 @@ func (i *identity) GetInternal(_ px.Context, externalID string) (internalID stri
 	return
 }
 
+// PeekExternal returns the external ID associated with the given internal ID or an empty string if no association
+// exists. Unlike GetExternal, it uses a read-only transaction and leaves the GC-era of the mapping unchanged
+func (i *identity) PeekExternal(_ px.Context, internalID string) (externalID string, found bool) {
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			if t := readTuple(tx, []byte(internalID)); t != nil {
+				externalID = t.ExternalID
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return
+}
+
+// PeekInternal returns the internal ID associated with the given external ID or an empty string if no association
+// exists. Unlike GetInternal, it uses a read-only transaction and leaves the GC-era of the mapping unchanged
+func (i *identity) PeekInternal(_ px.Context, externalID string) (internalID string, found bool) {
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			if iid := tx.Bucket(externalToInternal).Get([]byte(externalID)); iid != nil {
+				internalID = string(iid)
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return
+}
+
 // PurgeExternal explicitly removes any mappings involving the given external ID, both from the store
 // and from the garbage bin.
 func (i *identity) PurgeExternal(_ px.Context, externalID string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
 			eid := []byte(externalID)
-			i.removeExternal(tx, eid, false)
-			deleteFromBucket(tx, garbage, eid)
+			t := i.removeExternal(tx, eid, false)
+			i.recordRemoval(tx, t)
+			var g *tuple
+			if bs := tx.Bucket(garbage).Get(eid); bs != nil {
+				g = unmarshalTuple(bs)
+				deleteFromBucket(tx, garbage, eid)
+			}
+			i.audit(tx, `purgeExternal`, affected(t, g), externalID)
+			i.emit(tx, EventPurge, t)
+			i.emit(tx, EventPurge, g)
+			i.logPurged(tx, affected(t, g))
 			return nil
 		})
 		if err != nil {
@@ -308,13 +607,16 @@ func (i *identity) PurgeInternal(_ px.Context, internalID string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
 			iid := []byte(internalID)
-			i.removeInternal(tx, iid, false)
+			t := i.removeInternal(tx, iid, false)
+			i.recordRemoval(tx, t)
+			ts := affected(t)
 
 			// Remove any mapping to this internal ID that is found in garbage
 			es := make([][]byte, 0, 3)
 			err := tx.Bucket(garbage).ForEach(func(k, v []byte) error {
-				if unmarshalTuple(v).InternalID == internalID {
+				if g := unmarshalTuple(v); g.InternalID == internalID {
 					es = append(es, k)
+					ts = append(ts, g)
 				}
 				return nil
 			})
@@ -324,6 +626,11 @@ func (i *identity) PurgeInternal(_ px.Context, internalID string) {
 			for _, eid := range es {
 				deleteFromBucket(tx, garbage, eid)
 			}
+			i.audit(tx, `purgeInternal`, ts, internalID)
+			for _, pt := range ts {
+				i.emit(tx, EventPurge, pt)
+			}
+			i.logPurged(tx, ts)
 			return nil
 		})
 		if err != nil {
@@ -337,8 +644,17 @@ func (i *identity) PurgeReferences(_ px.Context, internalIDPrefix string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
 			era := i.readMetadata(tx).Era
-			_, err := i.buildReferences(tx, era, internalIDPrefix, true)
-			return err
+			refsInEra, err := readReferences(tx, func(r *reference) bool { return r.Era < era })
+			if err != nil {
+				return err
+			}
+			purged := reachableReferences(refsInEra, internalIDPrefix)
+			for _, ref := range purged {
+				deleteFromBucket(tx, references, refKey(ref.InternalID, ref.ExternalID))
+				onCommit(tx, i.log.Debug, "purged reference", "internalId", ref.InternalID, "prefix", ref.ExternalID, "era", ref.Era)
+			}
+			i.audit(tx, `purgeReferences`, purged, internalIDPrefix)
+			return nil
 		})
 		if err != nil {
 			panic(err)
@@ -350,7 +666,11 @@ func (i *identity) PurgeReferences(_ px.Context, internalIDPrefix string) {
 func (i *identity) RemoveExternal(_ px.Context, externalID string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
-			i.removeExternal(tx, []byte(externalID), true)
+			t := i.removeExternal(tx, []byte(externalID), true)
+			i.recordRemoval(tx, t)
+			i.audit(tx, `removeExternal`, affected(t), externalID)
+			i.emit(tx, EventRemove, t)
+			i.logRemoved(tx, t)
 			return nil
 		})
 		if err != nil {
@@ -363,7 +683,11 @@ func (i *identity) RemoveExternal(_ px.Context, externalID string) {
 func (i *identity) RemoveInternal(_ px.Context, internalID string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
-			i.removeInternal(tx, []byte(internalID), true)
+			t := i.removeInternal(tx, []byte(internalID), true)
+			i.recordRemoval(tx, t)
+			i.audit(tx, `removeInternal`, affected(t), internalID)
+			i.emit(tx, EventRemove, t)
+			i.logRemoved(tx, t)
 			return nil
 		})
 		if err != nil {
@@ -374,18 +698,37 @@ func (i *identity) RemoveInternal(_ px.Context, internalID string) {
 
 // Search finds all tuples that are keyed by an internalID prefixed by internalIDPrefix.
 //
-// Each tuple is a four element array consisting of InternalID, ExternalID, Timestamp, and GCEra. The
-// Pcore type of the tuple is Tuple[String, String, Timestamp, Integer]
+// Each tuple is a seven element array as described for ValueTuple.
 //
 // The tuples are returned in the order they were added to the store. An empty slice is returned when no tuples
 // are found.
-func (i *identity) Search(_ px.Context, internalIDPrefix string) px.List {
+func (i *identity) Search(c px.Context, internalIDPrefix string) px.List {
+	return i.SearchFiltered(c, internalIDPrefix, nil)
+}
+
+// SearchReferenced finds all tuples that are keyed by an internalID prefixed by internalIDPrefix or by the
+// prefix of a workflow that is referenced from it, directly or transitively. The references are expanded the
+// same way as for Sweep and Garbage so that all three agree on what belongs to a workflow.
+//
+// Each element is a two element array consisting of the tuple and the prefix that brought it in. The Pcore type
+// of the element is Tuple[Tuple[String, String, Timestamp, Integer, Integer, Timestamp, Timestamp], String]
+//
+// The elements are returned in the order the tuples were added to the store. An empty slice is returned when no
+// tuples are found.
+func (i *identity) SearchReferenced(_ px.Context, internalIDPrefix string) px.List {
 	found := make([]px.Value, 0, 32)
 	i.withDb(func(db *bolt.DB) {
 		err := db.View(func(tx *bolt.Tx) error {
+			era := i.readMetadata(tx).Era
+			refsInEra, err := readReferences(tx, func(r *reference) bool { return r.Era < era })
+			if err != nil {
+				return err
+			}
+
+			scopes := expandScopes(refsInEra, internalIDPrefix)
 			return tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
-				if strings.HasPrefix(string(k), internalIDPrefix) {
-					found = append(found, unmarshalTuple(v).ValueTuple())
+				if s := findScope(scopes, string(k)); s != nil {
+					found = append(found, types.WrapValues([]px.Value{unmarshalTuple(v).ValueTuple(), types.WrapString(s.prefix)}))
 				}
 				return nil
 			})
@@ -394,7 +737,10 @@ func (i *identity) Search(_ px.Context, internalIDPrefix string) px.List {
 			panic(err)
 		}
 	})
-	return sortedValueTuples(found)
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].(px.List).At(0).(px.List).At(4).(px.Integer).Int() < found[j].(px.List).At(0).(px.List).At(4).(px.Integer).Int()
+	})
+	return types.WrapValues(found)
 }
 
 // Sweep finds all tuples that are keyed by an internalID prefixed by internalIDPrefix and moves those of them that
@@ -405,12 +751,13 @@ func (i *identity) Sweep(_ px.Context, internalIDPrefix string) {
 	i.withDb(func(db *bolt.DB) {
 		err := db.Update(func(tx *bolt.Tx) error {
 			era := i.readMetadata(tx).Era
-			prefixes, err := i.buildReferences(tx, era, internalIDPrefix, false)
+			prefixes, err := i.buildReferences(tx, era, internalIDPrefix)
 			if err != nil {
 				return err
 			}
 
-			return tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+			var moved []*tuple
+			err = tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
 				found := false
 				id := string(k)
 				for _, pfx := range prefixes {
@@ -423,10 +770,20 @@ func (i *identity) Sweep(_ px.Context, internalIDPrefix string) {
 					t := unmarshalTuple(v)
 					if t.Era < era {
 						i.addToGarbage(tx, t)
+						moved = append(moved, t)
+						onCommit(tx, i.log.Debug, "moved mapping to garbage", "internalId", t.InternalID, "externalId", t.ExternalID, "era", t.Era)
 					}
 				}
 				return nil
 			})
+			if err == nil {
+				i.audit(tx, `sweep`, moved, internalIDPrefix)
+				for _, t := range moved {
+					i.emit(tx, EventGarbage, t)
+				}
+				onCommit(tx, i.log.Info, "swept", "prefix", internalIDPrefix, "era", era, "moved", len(moved))
+			}
+			return err
 		})
 		if err != nil {
 			panic(err)
@@ -434,13 +791,26 @@ func (i *identity) Sweep(_ px.Context, internalIDPrefix string) {
 	})
 }
 
-func (i *identity) buildReferences(tx *bolt.Tx, era int64, internalIDPrefix string, purge bool) ([]string, error) {
-	var refsInEra []*reference
-	rb := tx.Bucket(references)
-	err := rb.ForEach(func(k, v []byte) error {
+func (i *identity) buildReferences(tx *bolt.Tx, era int64, internalIDPrefix string) ([]string, error) {
+	refsInEra, err := readReferences(tx, func(r *reference) bool { return r.Era < era })
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := append(make([]string, 0, 16), internalIDPrefix)
+	for _, ref := range reachableReferences(refsInEra, internalIDPrefix) {
+		prefixes = append(prefixes, ref.ExternalID)
+	}
+	return prefixes, nil
+}
+
+// readReferences returns all references accepted by the filter, sorted on sequence number
+func readReferences(tx *bolt.Tx, filter func(*reference) bool) ([]*reference, error) {
+	var refs []*reference
+	err := tx.Bucket(references).ForEach(func(k, v []byte) error {
 		r := unmarshalReference(v)
-		if r.Era < era {
-			refsInEra = append(refsInEra, r)
+		if filter(r) {
+			refs = append(refs, r)
 		}
 		return nil
 	})
@@ -448,71 +818,80 @@ func (i *identity) buildReferences(tx *bolt.Tx, era int64, internalIDPrefix stri
 		return nil, err
 	}
 
-	prefixes := append(make([]string, 0, 16), internalIDPrefix)
-	if len(refsInEra) > 0 {
-		// Sort to ensure that nested references are resolved correctly
-		sort.Slice(refsInEra, func(i, j int) bool {
-			return refsInEra[i].Timestamp.Before(refsInEra[j].Timestamp)
-		})
+	// Sort to ensure that nested references are resolved correctly
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Seq < refs[j].Seq
+	})
+	return refs, nil
+}
 
-		// Retrieve all references that extend from the current references
-		for _, ref := range refsInEra {
-			found := false
-			for _, pfx := range prefixes {
-				if found = strings.HasPrefix(ref.InternalID, pfx); found {
-					break
-				}
-			}
-			if found {
-				if purge {
-					err = rb.Delete(refKey(ref.InternalID, ref.ExternalID))
-					if err != nil {
-						return nil, err
-					}
-				}
-				prefixes = append(prefixes, ref.ExternalID)
+// A scope is a prefix that is included when expanding another prefix through references. The via and parent
+// of the scope of the expanded prefix itself are nil.
+type scope struct {
+	prefix string
+	via    *reference
+	parent *scope
+}
+
+// path returns the chain of scopes that starts with the expanded prefix and ends with this scope
+func (s *scope) path() []*scope {
+	if s.parent == nil {
+		return []*scope{s}
+	}
+	return append(s.parent.path(), s)
+}
+
+// expandScopes returns the scopes that extend from the given internalIDPrefix, either directly or through
+// other references, using the references of the sorted refs slice. The first scope is the one of the
+// internalIDPrefix itself.
+func expandScopes(refs []*reference, internalIDPrefix string) []*scope {
+	scopes := append(make([]*scope, 0, 16), &scope{prefix: internalIDPrefix})
+	for _, ref := range refs {
+		for _, s := range scopes {
+			if strings.HasPrefix(ref.InternalID, s.prefix) {
+				scopes = append(scopes, &scope{prefix: ref.ExternalID, via: ref, parent: s})
+				break
 			}
 		}
 	}
-	return prefixes, nil
+	return scopes
+}
+
+// findScope returns the first of the given scopes that includes the internalID or nil if no such scope exists
+func findScope(scopes []*scope, internalID string) *scope {
+	for _, s := range scopes {
+		if strings.HasPrefix(internalID, s.prefix) {
+			return s
+		}
+	}
+	return nil
+}
+
+// reachableReferences returns the references of the sorted refs slice that extend from the given
+// internalIDPrefix, either directly or through other references
+func reachableReferences(refs []*reference, internalIDPrefix string) []*reference {
+	scopes := expandScopes(refs, internalIDPrefix)
+	reached := make([]*reference, len(scopes)-1)
+	for ix, s := range scopes[1:] {
+		reached[ix] = s.via
+	}
+	return reached
 }
 
 // Garbage finds all tuples that are keyed by an internalID prefixed by internalIDPrefix that have been moved to the
 // garbage bin. The tuples are returned in the order they were added to the store. An empty slice is returned when no
 // tuples are found.
-func (i *identity) Garbage(_ px.Context, internalIDPrefix string) px.List {
-	gs := make([]px.Value, 0, 32)
-	i.withDb(func(db *bolt.DB) {
-		err := db.View(func(tx *bolt.Tx) error {
-			era := i.readMetadata(tx).Era
-			prefixes, err := i.buildReferences(tx, era, internalIDPrefix, false)
-			if err != nil {
-				return err
-			}
-
-			return tx.Bucket(garbage).ForEach(func(k, v []byte) error {
-				t := unmarshalTuple(v)
-				for _, pfx := range prefixes {
-					if strings.HasPrefix(t.InternalID, pfx) {
-						gs = append(gs, t.ValueTuple())
-						break
-					}
-				}
-				return nil
-			})
-		})
-		if err != nil {
-			panic(err)
-		}
-	})
-	return sortedValueTuples(gs)
+func (i *identity) Garbage(c px.Context, internalIDPrefix string) px.List {
+	return i.GarbageFiltered(c, internalIDPrefix, nil)
 }
 
-func (i *identity) removeExternal(tx *bolt.Tx, eid []byte, moveToGarbage bool) {
+// removeExternal removes the mapping of the given external ID and returns the tuple that was removed from the
+// internal ID, if any
+func (i *identity) removeExternal(tx *bolt.Tx, eid []byte, moveToGarbage bool) *tuple {
 	// Remove any existing mapping
 	iid := tx.Bucket(externalToInternal).Get(eid)
 	if iid == nil {
-		return
+		return nil
 	}
 	deleteFromBucket(tx, externalToInternal, eid)
 
@@ -523,14 +902,17 @@ func (i *identity) removeExternal(tx *bolt.Tx, eid []byte, moveToGarbage bool) {
 		if moveToGarbage {
 			i.addToGarbage(tx, t)
 		}
+		return t
 	}
+	return nil
 }
 
-func (i *identity) removeInternal(tx *bolt.Tx, iid []byte, moveToGarbage bool) {
+// removeInternal removes the mapping of the given internal ID and returns the tuple that was removed, if any
+func (i *identity) removeInternal(tx *bolt.Tx, iid []byte, moveToGarbage bool) *tuple {
 	// Remove any existing mapping
 	t := readTuple(tx, iid)
 	if t == nil {
-		return
+		return nil
 	}
 	deleteFromBucket(tx, internalToExternal, iid)
 
@@ -542,26 +924,87 @@ func (i *identity) removeInternal(tx *bolt.Tx, iid []byte, moveToGarbage bool) {
 	if moveToGarbage {
 		i.addToGarbage(tx, t)
 	}
+	return t
 }
 
 func (i *identity) addToGarbage(tx *bolt.Tx, t *tuple) {
+	if t.Collected == nil {
+		now := time.Now()
+		t.Collected = &now
+	}
 	// Store bucket in garbage bin. Overwrite any previous entry for the same external ID.
 	putInBucket(tx, garbage, []byte(t.ExternalID), marshalTuple(t))
 }
 
+// onCommit logs the given message using the given function of a logger once the transaction has been committed
+func onCommit(tx *bolt.Tx, log func(msg string, args ...interface{}), msg string, args ...interface{}) {
+	tx.OnCommit(func() { log(msg, args...) })
+}
+
+// logRemoved logs the removal of a mapping, if any
+func (i *identity) logRemoved(tx *bolt.Tx, t *tuple) {
+	if t != nil {
+		onCommit(tx, i.log.Debug, "removed mapping", "internalId", t.InternalID, "externalId", t.ExternalID, "era", t.Era)
+	}
+}
+
+// logPurged logs the given mappings and garbage entries as purged
+func (i *identity) logPurged(tx *bolt.Tx, ts []*tuple) {
+	for _, t := range ts {
+		onCommit(tx, i.log.Debug, "purged mapping", "internalId", t.InternalID, "externalId", t.ExternalID, "era", t.Era)
+	}
+}
+
 func (i *identity) withDb(df func(*bolt.DB)) {
-	i.lock.Lock()
+	i.lock.RLock()
+	defer i.lock.RUnlock()
 
-	db, err := bolt.Open(i.filename, 0600, nil)
-	if err != nil {
-		panic(err)
+	db := i.acquireDb()
+	defer i.releaseDb()
+	df(db)
+}
+
+// acquireDb returns the shared Bolt database, opening it if no other request is using it. The caller must hold
+// the lock of the identity for reading
+func (i *identity) acquireDb() *bolt.DB {
+	i.dbLock.Lock()
+	defer i.dbLock.Unlock()
+	if i.db == nil {
+		i.db = i.openDb()
 	}
+	i.users++
+	return i.db
+}
+
+// releaseDb closes the shared Bolt database when the last request that uses it is done
+func (i *identity) releaseDb() {
+	i.dbLock.Lock()
+	defer i.dbLock.Unlock()
+	if i.users--; i.users == 0 {
+		_ = i.db.Close()
+		i.db = nil
+	}
+}
 
-	defer func() {
+// openDb opens the Bolt database. The caller must hold the lock of the identity
+func (i *identity) openDb() *bolt.DB {
+	for {
+		before, _ := os.Stat(i.filename)
+		db, err := bolt.Open(i.filename, i.options.FileMode, i.options.boltOptions())
+		if err != nil {
+			if err == bolt.ErrTimeout {
+				panic(lockedError(i.filename))
+			}
+			panic(err)
+		}
+
+		// A Compact or Restore in another process may have replaced the file while Open waited for its lock, in
+		// which case the file that was opened is no longer the store
+		if after, _ := os.Stat(i.filename); before == nil || after != nil && os.SameFile(before, after) {
+			return db
+		}
 		_ = db.Close()
-		i.lock.Unlock()
-	}()
-	df(db)
+	}
 }
 
 func (i *identity) readMetadata(tx *bolt.Tx) *storeMeta {
@@ -576,7 +1019,19 @@ func (i *identity) updateEra(t *tuple, tx *bolt.Tx) {
 	md := i.readMetadata(tx)
 	if t.Era < md.Era {
 		t.Era = md.Era
+		t.Seen = time.Now()
 		putInBucket(tx, internalToExternal, []byte(t.InternalID), marshalTuple(t))
+		onCommit(tx, i.log.Trace, "updated era of mapping", "internalId", t.InternalID, "era", t.Era)
+	}
+}
+
+func (i *identity) updateReferenceEra(r *reference, tx *bolt.Tx) {
+	md := i.readMetadata(tx)
+	if r.Era < md.Era {
+		r.Era = md.Era
+		r.Seen = time.Now()
+		putInBucket(tx, references, refKey(r.InternalID, r.ExternalID), marshalReference(r))
+		onCommit(tx, i.log.Trace, "updated era of reference", "internalId", r.InternalID, "prefix", r.ExternalID, "era", r.Era)
 	}
 }
 
@@ -636,19 +1091,25 @@ func marshalUnknown(n string, s interface{}) []byte {
 }
 
 func unmarshalUnknown(n string, src []byte, s interface{}) {
+	if err := decodeUnknown(n, src, s); err != nil {
+		panic(err)
+	}
+}
+
+func decodeUnknown(n string, src []byte, s interface{}) error {
 	b := bytes.NewBuffer(src)
 	d := gob.NewDecoder(b)
 	err := d.Decode(s)
 	if err != nil {
-		panic(errorf("failed to decode %s: %s", n, err))
+		return errorf("failed to decode %s: %s", n, err)
 	}
+	return nil
 }
 
+// sortedValueTuples sorts value tuples in the order they were added to the store, i.e. by sequence number
 func sortedValueTuples(vts []px.Value) px.List {
-	sort.Slice(vts, func(i, j int) bool {
-		t1 := vts[i].(px.List).At(2).(*types.Timestamp).Time()
-		t2 := vts[j].(px.List).At(2).(*types.Timestamp).Time()
-		return t1.Before(t2)
+	sort.SliceStable(vts, func(i, j int) bool {
+		return vts[i].(px.List).At(4).(px.Integer).Int() < vts[j].(px.List).At(4).(px.Integer).Int()
 	})
 	return types.WrapValues(vts)
 }
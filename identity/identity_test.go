@@ -1,15 +1,29 @@
 package identity
 
 import (
+	"bytes"
 	"github.com/lyraproj/pcore/pcore"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/lyraproj/servicesdk/service"
 	"github.com/lyraproj/servicesdk/serviceapi"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
+func TestMain(m *testing.M) {
+	// Keep the output of the tests free from the info messages of the stores they create
+	if _, ok := os.LookupEnv(OptionEnv[OptionLogLevel]); !ok {
+		_ = os.Setenv(OptionEnv[OptionLogLevel], `warn`)
+	}
+	os.Exit(m.Run())
+}
+
 func deleteFile(filename string) {
 	_, err := os.Stat(filename)
 	if err != nil {
@@ -69,6 +83,21 @@ func TestBasicFunctionality(t *testing.T) {
 	})
 }
 
+func TestServiceRegistration(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestServiceRegistration.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		// All exported methods must be reflectable by the service builder
+		sb := service.NewServiceBuilder(c, "Identity")
+		sb.RegisterAPI("Identity::Service", NewIdentity(filename))
+		s := sb.Server()
+		s.Invoke(c, "Identity::Service", "associate", types.WrapString("i1"), types.WrapString("e1"))
+		require.Equal(t, "['e1', true]", s.Invoke(c, "Identity::Service", "getExternal", types.WrapString("i1")).String())
+	})
+}
+
 func TestBasicFunctionalityAcrossInstances(t *testing.T) {
 	pcore.Do(func(c px.Context) {
 		// Set up a clean DB
@@ -259,6 +288,35 @@ func TestAccessSetEra(t *testing.T) {
 	})
 }
 
+func TestPeekKeepsEra(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestPeekKeepsEra.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.BumpEra(c)
+
+		eid, found := id.PeekExternal(c, "a:i1")
+		require.True(t, found)
+		require.Equal(t, "e1", eid)
+		iid, found := id.PeekInternal(c, "e1")
+		require.True(t, found)
+		require.Equal(t, "a:i1", iid)
+
+		_, found = id.PeekExternal(c, "a:i2")
+		require.False(t, found)
+		_, found = id.PeekInternal(c, "e2")
+		require.False(t, found)
+
+		// Peeking leaves the era unchanged so the mapping is still swept
+		require.EqualValues(t, int64(0), id.Search(c, "a:").At(0).(px.List).At(3).(px.Number).Int())
+		id.Sweep(c, "a:")
+		require.EqualValues(t, 1, id.Garbage(c, "a:").Len())
+	})
+}
+
 func TestSweep(t *testing.T) {
 	pcore.Do(func(c px.Context) {
 		filename := "TestSearchGarbage.db"
@@ -370,3 +428,130 @@ func TestPurge(t *testing.T) {
 		require.EqualValues(t, "e3", garbage.At(0).(px.List).At(1).String())
 	})
 }
+
+func TestSearchReferenced(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSearchReferenced.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.AddReference(c, "a:i2", "b:")
+		id.Associate(c, "b:i1", "e2")
+		id.AddReference(c, "b:i2", "c:")
+		id.Associate(c, "c:i1", "e3")
+		id.Associate(c, "x:i1", "e4")
+		id.BumpEra(c)
+
+		found := id.SearchReferenced(c, "a:")
+		require.EqualValues(t, 3, found.Len())
+		require.Equal(t, "a:i1", found.At(0).(px.List).At(0).(px.List).At(0).String())
+		require.Equal(t, "a:", found.At(0).(px.List).At(1).String())
+		require.Equal(t, "b:i1", found.At(1).(px.List).At(0).(px.List).At(0).String())
+		require.Equal(t, "b:", found.At(1).(px.List).At(1).String())
+		require.Equal(t, "c:i1", found.At(2).(px.List).At(0).(px.List).At(0).String())
+		require.Equal(t, "c:", found.At(2).(px.List).At(1).String())
+
+		// Agrees with Garbage after a Sweep
+		id.Sweep(c, "a:")
+		garbage := id.Garbage(c, "a:")
+		require.EqualValues(t, 3, garbage.Len())
+		for ix := 0; ix < 3; ix++ {
+			require.Equal(t, found.At(ix).(px.List).At(0).(px.List).At(0), garbage.At(ix).(px.List).At(0))
+		}
+	})
+}
+
+func bufferLogger(level string) (hclog.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	return hclog.New(&hclog.LoggerOptions{Output: buf, Level: hclog.LevelFromString(level)}), buf
+}
+
+func TestLogging(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestLogging.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		o := DefaultOptions()
+		o.DB = filename
+		log, buf := bufferLogger(`debug`)
+		o.Logger = log
+		id := NewIdentityWithOptions(o)
+		require.Contains(t, buf.String(), `[INFO]  created identity store:`)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i1", "e2")
+		id.Associate(c, "a:i2", "e2")
+		id.BumpEra(c)
+		id.Sweep(c, "a:")
+		id.PurgeInternal(c, "a:i2")
+
+		out := buf.String()
+		require.Contains(t, out, `[DEBUG] replaced mapping: internalId=a:i1 externalId=e1 newExternalId=e2`)
+		require.Contains(t, out, `[DEBUG] replaced mapping: internalId=a:i1 externalId=e2 newInternalId=a:i2`)
+		require.Contains(t, out, `[INFO]  bumped era: era=1`)
+		require.Contains(t, out, `[DEBUG] moved mapping to garbage: internalId=a:i2 externalId=e2 era=0`)
+		require.Contains(t, out, `[INFO]  swept: prefix=a: era=1 moved=1`)
+		require.Contains(t, out, `[DEBUG] purged mapping: internalId=a:i2 externalId=e2`)
+
+		// Refreshing an identical mapping is only logged at trace level
+		require.NotContains(t, out, `refreshed mapping`)
+	})
+}
+
+func TestDefaultLogger(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestDefaultLogger.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		buf := &bytes.Buffer{}
+		saved := hclog.DefaultOptions
+		hclog.DefaultOptions = &hclog.LoggerOptions{Output: buf, Level: hclog.Info}
+		defer func() { hclog.DefaultOptions = saved }()
+
+		// Without a Logger, the log level of the options is used
+		o := DefaultOptions()
+		o.DB = filename
+		o.LogLevel = `debug`
+		NewIdentityWithOptions(o).Associate(c, "a:i1", "e1")
+		require.Contains(t, buf.String(), `[DEBUG] associated: internalId=a:i1 externalId=e1`)
+
+		buf.Reset()
+		o.LogLevel = `error`
+		NewIdentityWithOptions(o).BumpEra(c)
+		require.Empty(t, buf.String())
+	})
+}
+
+func TestLogMigration(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestLogMigration.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		corrupt(filename, func(tx *bolt.Tx) error {
+			for _, bn := range [][]byte{metadata, internalToExternal, externalToInternal, garbage, references, history} {
+				if _, err := tx.CreateBucket(bn); err != nil {
+					return err
+				}
+			}
+			putInBucket(tx, metadata, metadata, marshalMetadata(&storeMeta{Version: `1.4.0`, Timestamp: time.Now(), Seq: 0}))
+			return nil
+		})
+
+		o := DefaultOptions()
+		o.DB = filename
+		log, buf := bufferLogger(`info`)
+		o.Logger = log
+		NewIdentityWithOptions(o)
+		require.Contains(t, buf.String(), `[INFO]  upgraded identity store: db=`)
+		require.Contains(t, buf.String(), `from=1.4.0 to=`+identityStoreVersion.String())
+
+		// A store of the current version is not upgraded again
+		buf.Reset()
+		NewIdentityWithOptions(o)
+		require.Empty(t, buf.String())
+	})
+}
@@ -0,0 +1,174 @@
+package identity
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/lyraproj/pcore/px"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Fields that SearchMatching can match against
+const (
+	FieldInternal = `internal`
+	FieldExternal = `external`
+)
+
+// Modes of matching used by SearchMatching
+const (
+	MatchPrefix = `prefix`
+	MatchGlob   = `glob`
+	MatchRegex  = `regex`
+)
+
+// SearchExternal finds all tuples whose externalID is prefixed by externalIDPrefix.
+//
+// Each tuple is a seven element array as described for ValueTuple.
+//
+// The tuples are returned in the order they were added to the store. An empty slice is returned when no tuples
+// are found.
+func (i *identity) SearchExternal(c px.Context, externalIDPrefix string) px.List {
+	return i.SearchMatching(c, FieldExternal, MatchPrefix, externalIDPrefix)
+}
+
+// SearchMatching finds all tuples where the given field, "internal" or "external", matches the pattern. The
+// mode determines how the pattern is interpreted:
+//
+//	prefix  the ID starts with the pattern
+//	glob    the whole ID matches the pattern where * matches any sequence of characters, ? matches one
+//	        character, and [...] matches one character in a class. A backslash escapes the next character
+//	regex   the ID contains a match for the regular expression using Go RE2 syntax
+//
+// The tuples are returned in the order they were added to the store.
+func (i *identity) SearchMatching(_ px.Context, field, mode, pattern string) px.List {
+	var bn []byte
+	switch field {
+	case FieldInternal:
+		bn = internalToExternal
+	case FieldExternal:
+		bn = externalToInternal
+	default:
+		panic(errorf("unknown search field '%s'. Expected internal or external", field))
+	}
+	prefix, match := compileMatcher(mode, pattern)
+
+	found := make([]px.Value, 0, 32)
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(bn).Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if !match(string(k)) {
+					continue
+				}
+				var t *tuple
+				if field == FieldExternal {
+					t = readTuple(tx, v)
+				} else {
+					t = unmarshalTuple(v)
+				}
+				if t != nil {
+					found = append(found, t.ValueTuple())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return sortedValueTuples(found)
+}
+
+// compileMatcher returns a key prefix that all matching IDs have in common and a function that matches an ID
+func compileMatcher(mode, pattern string) ([]byte, func(string) bool) {
+	switch mode {
+	case MatchPrefix:
+		return []byte(pattern), func(string) bool { return true }
+	case MatchGlob:
+		expr, literal := globToRegexp(pattern)
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			panic(errorf("invalid glob pattern '%s': %s", pattern, err))
+		}
+		return []byte(literal), re.MatchString
+	case MatchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			panic(errorf("invalid regular expression '%s': %s", pattern, err))
+		}
+		return nil, re.MatchString
+	}
+	panic(errorf("unknown match mode '%s'. Expected prefix, glob, or regex", mode))
+}
+
+// globToRegexp translates a glob pattern to an anchored regular expression and returns it together with the
+// literal prefix of the pattern
+func globToRegexp(glob string) (string, string) {
+	b := bytes.NewBufferString(`^`)
+	literal := -1
+	rs := []rune(glob)
+	for ix := 0; ix < len(rs); ix++ {
+		r := rs[ix]
+		switch r {
+		case '*', '?', '[':
+			if literal < 0 {
+				literal = ix
+			}
+		}
+		switch r {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '[':
+			end := ix + 1
+			if end < len(rs) && (rs[end] == '!' || rs[end] == '^') {
+				end++
+			}
+			if end < len(rs) && rs[end] == ']' {
+				end++
+			}
+			for end < len(rs) && rs[end] != ']' {
+				end++
+			}
+			if end == len(rs) {
+				panic(errorf("invalid glob pattern '%s': missing ]", glob))
+			}
+			class := string(rs[ix+1 : end])
+			if strings.HasPrefix(class, `!`) {
+				class = `^` + class[1:]
+			}
+			b.WriteString(`[` + strings.Replace(class, `\`, `\\`, -1) + `]`)
+			ix = end
+		case '\\':
+			if ix+1 < len(rs) {
+				ix++
+				r = rs[ix]
+			}
+			fallthrough
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`$`)
+
+	if literal < 0 {
+		literal = len(rs)
+	}
+	return b.String(), unescapeGlob(string(rs[:literal]))
+}
+
+func unescapeGlob(s string) string {
+	b := bytes.NewBuffer(nil)
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+// tupleIDs returns the internal IDs of the given tuples
+func tupleIDs(tuples px.List) []string {
+	ids := make([]string, tuples.Len())
+	tuples.EachWithIndex(func(t px.Value, ix int) { ids[ix] = t.(px.List).At(0).String() })
+	return ids
+}
+
+func TestSearchExternal(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSearchExternal.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "/subscriptions/s1/groups/g1/vm1")
+		id.Associate(c, "a:i2", "/subscriptions/s2/groups/g1/vm2")
+		id.Associate(c, "b:i1", "/subscriptions/s1/groups/g2/disk1")
+		id.Associate(c, "b:i2", "arn:aws:ec2:vm3")
+
+		require.Equal(t, []string{"a:i1", "b:i1"}, tupleIDs(id.SearchExternal(c, "/subscriptions/s1/")))
+		require.Equal(t, []string{}, tupleIDs(id.SearchExternal(c, "/subscriptions/s3/")))
+		id.RemoveInternal(c, "a:i1")
+		require.Equal(t, []string{"b:i1"}, tupleIDs(id.SearchExternal(c, "/subscriptions/s1/")))
+	})
+}
+
+func TestSearchMatching(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSearchMatching.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "/subscriptions/s1/groups/g1/vm1")
+		id.Associate(c, "a:i2", "/subscriptions/s2/groups/g1/vm2")
+		id.Associate(c, "b:i1", "/subscriptions/s1/groups/g2/disk1")
+		id.Associate(c, "b:j*", "arn:aws:ec2:vm3")
+
+		require.Equal(t, []string{"a:i1", "a:i2"}, tupleIDs(id.SearchMatching(c, FieldExternal, MatchGlob, "/subscriptions/*/groups/g1/*")))
+		require.Equal(t, []string{"a:i1", "b:i1"}, tupleIDs(id.SearchMatching(c, FieldExternal, MatchGlob, "/subscriptions/s[!2]/*")))
+		require.Equal(t, []string{"a:i1", "a:i2"}, tupleIDs(id.SearchMatching(c, FieldExternal, MatchRegex, `^/.*vm\d$`)))
+		require.Equal(t, []string{"a:i1", "b:i1"}, tupleIDs(id.SearchMatching(c, FieldInternal, MatchGlob, "?:i1")))
+		require.Equal(t, []string{"b:j*"}, tupleIDs(id.SearchMatching(c, FieldInternal, MatchGlob, `b:j\*`)))
+		require.Equal(t, []string{"a:i2"}, tupleIDs(id.SearchMatching(c, FieldInternal, MatchRegex, `^a:.2`)))
+		require.Equal(t, []string{"b:i1", "b:j*"}, tupleIDs(id.SearchMatching(c, FieldInternal, MatchPrefix, "b:")))
+
+		require.Panics(t, func() { id.SearchMatching(c, "name", MatchPrefix, "a") })
+		require.Panics(t, func() { id.SearchMatching(c, FieldInternal, "fuzzy", "a") })
+		require.Panics(t, func() { id.SearchMatching(c, FieldInternal, MatchGlob, "a[") })
+		require.Panics(t, func() { id.SearchMatching(c, FieldInternal, MatchRegex, "a(") })
+	})
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	expr, literal := globToRegexp(`a.b\?c*[!x]`)
+	require.Equal(t, `^a\.b\?c.*[^x]$`, expr)
+	require.Equal(t, `a.b?c`, literal)
+}
@@ -0,0 +1,241 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// Options controls where the identity store is located and how it is opened
+type Options struct {
+	// DB is the path of the store file
+	DB string
+
+	// FileMode is the permissions used when the store file is created
+	FileMode os.FileMode
+
+	// Timeout is the amount of time to wait for the file lock of the store. Zero means wait indefinitely
+	Timeout time.Duration
+
+	// Sync determines if the store file is synced to disk after each transaction
+	Sync bool
+
+	// FreelistSync determines if the freelist is written to the store file. Not writing it speeds up writes
+	// but requires a full scan of the store when it is opened
+	FreelistSync bool
+
+	// InitialMmapSize is the initial size in bytes of the memory map of the store file. Read transactions do
+	// not block write transactions as long as the store fits within the memory map
+	InitialMmapSize int
+
+	// LogLevel is the level used by the logger of the service: trace, debug, info, warn, or error. Defaults to
+	// the level given by LYRA_LOG_LEVEL or info
+	LogLevel string
+
+	// Caller identifies who makes the changes recorded in the audit log of the store. Defaults to the name of
+	// the user running the process
+	Caller string
+
+	// Logger is used to log the operations of the service. Defaults to a logger created from the default hclog
+	// options at LogLevel
+	Logger hclog.Logger
+}
+
+// Names of the settings that can be given to Options.Set, in a configuration file, or as command line flags
+const (
+	OptionDB       = `db`
+	OptionFileMode = `fileMode`
+	OptionTimeout  = `timeout`
+	OptionSync     = `sync`
+	OptionLogLevel = `logLevel`
+	OptionCaller   = `caller`
+
+	OptionFreelistSync    = `freelistSync`
+	OptionInitialMmapSize = `initialMmapSize`
+)
+
+// EnvConfig is the environment variable that names a configuration file
+const EnvConfig = `LYRA_IDENTITY_CONFIG`
+
+// OptionEnv maps each setting to the environment variable that overrides it
+var OptionEnv = map[string]string{
+	OptionDB:       `LYRA_IDENTITY_DB`,
+	OptionFileMode: `LYRA_IDENTITY_FILE_MODE`,
+	OptionTimeout:  `LYRA_IDENTITY_TIMEOUT`,
+	OptionSync:     `LYRA_IDENTITY_SYNC`,
+	OptionLogLevel: `LYRA_LOG_LEVEL`,
+	OptionCaller:   `LYRA_IDENTITY_CALLER`,
+
+	OptionFreelistSync:    `LYRA_IDENTITY_FREELIST_SYNC`,
+	OptionInitialMmapSize: `LYRA_IDENTITY_INITIAL_MMAP_SIZE`,
+}
+
+// DefaultOptions returns the options used when nothing else is configured
+func DefaultOptions() *Options {
+	return &Options{
+		DB:       `identity.db`,
+		FileMode: 0600,
+		Timeout:  10 * time.Second,
+		Sync:     true,
+		LogLevel: defaultLogLevel(),
+		Caller:   defaultCaller(),
+
+		FreelistSync:    true,
+		InitialMmapSize: 0,
+	}
+}
+
+// Set assigns the setting with the given name from its string representation. The file mode is given in
+// octal, the timeout as a duration such as "5s", the initial mmap size in bytes, and sync and freelistSync as
+// booleans.
+func (o *Options) Set(name, value string) error {
+	value = strings.TrimSpace(value)
+	switch name {
+	case OptionDB:
+		o.DB = value
+	case OptionFileMode:
+		m, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return errorf("invalid %s '%s'. Expected an octal number such as 0600", name, value)
+		}
+		o.FileMode = os.FileMode(m)
+	case OptionTimeout:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errorf("invalid %s '%s'. Expected a duration such as 5s", name, value)
+		}
+		o.Timeout = d
+	case OptionSync:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errorf("invalid %s '%s'. Expected true or false", name, value)
+		}
+		o.Sync = b
+	case OptionFreelistSync:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errorf("invalid %s '%s'. Expected true or false", name, value)
+		}
+		o.FreelistSync = b
+	case OptionInitialMmapSize:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errorf("invalid %s '%s'. Expected a number of bytes", name, value)
+		}
+		o.InitialMmapSize = n
+	case OptionLogLevel:
+		o.LogLevel = strings.ToLower(value)
+	case OptionCaller:
+		o.Caller = value
+	default:
+		return errorf("unknown setting '%s'", name)
+	}
+	return nil
+}
+
+// ReadFile assigns the settings found in the given configuration file. The file must contain a JSON object
+// when its extension is .json and a YAML mapping otherwise. Settings that are absent retain their value.
+func (o *Options) ReadFile(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]string)
+	if strings.ToLower(filepath.Ext(path)) == `.json` {
+		var raw map[string]json.RawMessage
+		if err = json.Unmarshal(bs, &raw); err == nil {
+			for k, v := range raw {
+				var s string
+				if json.Unmarshal(v, &s) != nil {
+					// Not a string so use the JSON number or boolean as is
+					s = string(v)
+				}
+				settings[k] = s
+			}
+		}
+	} else {
+		err = yaml.Unmarshal(bs, &settings)
+	}
+	if err != nil {
+		return errorf("failed to read configuration file '%s': %s", path, err)
+	}
+
+	for k, v := range settings {
+		if err = o.Set(k, v); err != nil {
+			return fmt.Errorf("configuration file '%s': %s", path, err)
+		}
+	}
+	return nil
+}
+
+// ReadEnv assigns the settings for which the environment variable given by OptionEnv is set. The lookup
+// function is typically os.LookupEnv.
+func (o *Options) ReadEnv(lookup func(string) (string, bool)) error {
+	for name, env := range OptionEnv {
+		if v, ok := lookup(env); ok && v != `` {
+			if err := o.Set(name, v); err != nil {
+				return fmt.Errorf("environment variable %s: %s", env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate asserts that the options can be used to open a store
+func (o *Options) Validate() error {
+	switch {
+	case o.DB == ``:
+		return errorf("%s must not be empty", OptionDB)
+	case o.FileMode&^os.ModePerm != 0:
+		return errorf("%s %#o is not a permission", OptionFileMode, o.FileMode)
+	case o.FileMode&0600 != 0600:
+		return errorf("%s %#o must permit the owner to read and write", OptionFileMode, o.FileMode)
+	case o.Timeout < 0:
+		return errorf("%s must not be negative", OptionTimeout)
+	case o.InitialMmapSize < 0:
+		return errorf("%s must not be negative", OptionInitialMmapSize)
+	case hclog.LevelFromString(o.LogLevel) == hclog.NoLevel:
+		return errorf("invalid %s '%s'. Expected trace, debug, info, warn, or error", OptionLogLevel, o.LogLevel)
+	}
+	return nil
+}
+
+// defaultLogLevel returns the level given by LYRA_LOG_LEVEL, so that every entry point honors it, or info when it
+// is not set to a valid level
+func defaultLogLevel() string {
+	l := strings.ToLower(strings.TrimSpace(os.Getenv(OptionEnv[OptionLogLevel])))
+	if hclog.LevelFromString(l) != hclog.NoLevel {
+		return l
+	}
+	return `info`
+}
+
+// defaultCaller returns the name of the user running the process or an empty string if it cannot be determined
+func defaultCaller() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ``
+}
+
+// boltOptions returns the options used when opening the store with Bolt
+func (o *Options) boltOptions() *bolt.Options {
+	return &bolt.Options{
+		Timeout:         o.Timeout,
+		NoSync:          !o.Sync,
+		NoFreelistSync:  !o.FreelistSync,
+		InitialMmapSize: o.InitialMmapSize,
+		FreelistType:    bolt.FreelistArrayType,
+	}
+}
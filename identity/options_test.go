@@ -0,0 +1,140 @@
+package identity
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestOptionsPrecedence(t *testing.T) {
+	config := "TestOptionsPrecedence.yaml"
+	deleteFile(config)
+	defer deleteFile(config)
+	require.NoError(t, ioutil.WriteFile(config, []byte("db: file.db\nfileMode: 0640\ntimeout: 2s\nsync: false\n"), 0600))
+
+	o := DefaultOptions()
+	require.NoError(t, o.ReadFile(config))
+	require.Equal(t, "file.db", o.DB)
+	require.Equal(t, os.FileMode(0640), o.FileMode)
+	require.Equal(t, 2*time.Second, o.Timeout)
+	require.False(t, o.Sync)
+	require.Equal(t, defaultLogLevel(), o.LogLevel)
+
+	env := map[string]string{`LYRA_IDENTITY_DB`: `env.db`, `LYRA_LOG_LEVEL`: `DEBUG`}
+	require.NoError(t, o.ReadEnv(func(n string) (string, bool) { v, ok := env[n]; return v, ok }))
+	require.Equal(t, "env.db", o.DB)
+	require.Equal(t, "debug", o.LogLevel)
+	require.Equal(t, 2*time.Second, o.Timeout)
+
+	require.NoError(t, o.Set(OptionDB, "flag.db"))
+	require.Equal(t, "flag.db", o.DB)
+	require.NoError(t, o.Validate())
+}
+
+func TestOptionsJSONFile(t *testing.T) {
+	config := "TestOptionsJSONFile.json"
+	deleteFile(config)
+	defer deleteFile(config)
+	require.NoError(t, ioutil.WriteFile(config, []byte(`{"db": "file.db", "fileMode": "0660", "sync": false}`), 0600))
+
+	o := DefaultOptions()
+	require.NoError(t, o.ReadFile(config))
+	require.Equal(t, "file.db", o.DB)
+	require.Equal(t, os.FileMode(0660), o.FileMode)
+	require.False(t, o.Sync)
+
+	require.NoError(t, ioutil.WriteFile(config, []byte(`{"dbFile": "file.db"}`), 0600))
+	require.Error(t, o.ReadFile(config))
+}
+
+func TestOptionsValidate(t *testing.T) {
+	require.NoError(t, DefaultOptions().Validate())
+
+	o := DefaultOptions()
+	require.Error(t, o.Set(OptionFileMode, "rw"))
+	require.Error(t, o.Set(OptionTimeout, "5"))
+	require.Error(t, o.Set(OptionSync, "maybe"))
+	require.Error(t, o.Set("size", "1"))
+
+	for _, bad := range []func(o *Options){
+		func(o *Options) { o.DB = `` },
+		func(o *Options) { o.FileMode = 0400 },
+		func(o *Options) { o.FileMode = os.ModeDir | 0600 },
+		func(o *Options) { o.Timeout = -time.Second },
+		func(o *Options) { o.LogLevel = `verbose` },
+	} {
+		o := DefaultOptions()
+		bad(o)
+		require.Error(t, o.Validate())
+	}
+}
+
+func TestNewIdentityWithOptions(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestNewIdentityWithOptions.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		o := DefaultOptions()
+		o.DB = filename
+		o.FileMode = 0640
+		o.Sync = false
+		id := NewIdentityWithOptions(o)
+		id.Associate(c, "i1", "e1")
+		checkGetExternal(t, c, id, "i1", "e1")
+
+		fi, err := os.Stat(filename)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+		o = DefaultOptions()
+		o.DB = ``
+		require.Panics(t, func() { NewIdentityWithOptions(o) })
+	})
+}
+
+func TestLockedStore(t *testing.T) {
+	filename := "TestLockedStore.db"
+	deleteFile(filename)
+	defer deleteFile(filename)
+
+	db, err := bolt.Open(filename, 0600, nil)
+	require.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	o := DefaultOptions()
+	o.DB = filename
+	o.Timeout = 100 * time.Millisecond
+	o.InitialMmapSize = 1 << 20
+	o.FreelistSync = false
+	require.PanicsWithValue(t, errorf("identity store at '%s' is locked by another process", newIdentity(o).filename),
+		func() { NewIdentityWithOptions(o) })
+}
+
+func TestDefaultLogLevel(t *testing.T) {
+	name := OptionEnv[OptionLogLevel]
+	saved, set := os.LookupEnv(name)
+	defer func() {
+		if set {
+			_ = os.Setenv(name, saved)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	}()
+
+	require.NoError(t, os.Setenv(name, ` DEBUG `))
+	require.Equal(t, "debug", DefaultOptions().LogLevel)
+	require.NoError(t, os.Setenv(name, `verbose`))
+	require.Equal(t, "info", DefaultOptions().LogLevel)
+	require.NoError(t, os.Unsetenv(name))
+	require.Equal(t, "info", DefaultOptions().LogLevel)
+	require.NoError(t, DefaultOptions().Validate())
+}
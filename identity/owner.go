@@ -0,0 +1,153 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Version is the version of the Identity service. It is recorded in the owner file of the store
+var Version = `0.1.0`
+
+// An Owner describes the process that runs the service of a store. It is written to a file next to the store
+// when the service starts so that a process waiting for the lock of the store can tell who holds it.
+type Owner struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	StartTime time.Time `json:"startTime"`
+	Version   string    `json:"version"`
+}
+
+// OwnerFile returns the name of the owner file of the given store file
+func OwnerFile(filename string) string {
+	return filename + `.owner`
+}
+
+// ReadOwner returns the owner recorded for the given store file or nil when no owner is recorded
+func ReadOwner(filename string) (*Owner, error) {
+	bs, err := ioutil.ReadFile(OwnerFile(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	o := &Owner{}
+	if err = json.Unmarshal(bs, o); err != nil {
+		return nil, errorf("owner file '%s' is invalid: %s", OwnerFile(filename), err)
+	}
+	return o, nil
+}
+
+// Alive returns true if the owner process is still running. The known result is false when that cannot be
+// determined because the owner runs on another host.
+func (o *Owner) Alive() (alive, known bool) {
+	if host, err := os.Hostname(); err != nil || host != o.Host {
+		return false, false
+	}
+	return processAlive(o.PID), true
+}
+
+func (o *Owner) String() string {
+	return fmt.Sprintf("pid %d on %s, started %s, version %s", o.PID, o.Host, o.StartTime.Format(time.RFC3339), o.Version)
+}
+
+func (o *Owner) valueHash() px.OrderedMap {
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`pid`, types.WrapInteger(int64(o.PID))),
+		types.WrapHashEntry2(`host`, types.WrapString(o.Host)),
+		types.WrapHashEntry2(`startTime`, types.WrapTimestamp(o.StartTime)),
+		types.WrapHashEntry2(`version`, types.WrapString(o.Version))})
+}
+
+// writeOwner records the current process as the owner of the given store file. The owner file is created with
+// the given permissions, which should be those of the store file
+func writeOwner(filename string, mode os.FileMode) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(&Owner{PID: os.Getpid(), Host: host, StartTime: time.Now(), Version: Version}, ``, `  `)
+	if err != nil {
+		return err
+	}
+	tmp := OwnerFile(filename) + `.tmp`
+	_ = os.Remove(tmp)
+	if err = ioutil.WriteFile(tmp, bs, mode); err == nil {
+		err = os.Rename(tmp, OwnerFile(filename))
+	}
+	return err
+}
+
+// removeOwner removes the owner file of the given store file if it was written by the current process
+func removeOwner(filename string) {
+	if o, err := ReadOwner(filename); err == nil && o != nil && o.PID == os.Getpid() {
+		_ = os.Remove(OwnerFile(filename))
+	}
+}
+
+// lockedError returns the error raised when the given store file is locked by another process. The error
+// describes the owner of the store when one is recorded.
+func lockedError(filename string) error {
+	o, err := ReadOwner(filename)
+	if err != nil || o == nil {
+		return errorf("identity store at '%s' is locked by another process", filename)
+	}
+	state := `not running`
+	if alive, known := o.Alive(); !known {
+		state = `on another host`
+	} else if alive {
+		state = `running`
+	}
+	return errorf("identity store at '%s' is locked by another process. Owner is %s (%s)", filename, o, state)
+}
+
+// Status returns a Hash describing the store in the given file. The entries are db, exists, locked, owner, and
+// alive. The owner is undefined when no owner is recorded and alive is undefined when the owner is undefined or
+// runs on another host. A store is locked when a shared lock cannot be obtained within the given timeout.
+func Status(filename string, timeout time.Duration) px.OrderedMap {
+	absName, err := filepath.Abs(filename)
+	if err != nil {
+		panic(err)
+	}
+	exists := true
+	locked := false
+	if _, err = os.Stat(absName); os.IsNotExist(err) {
+		exists = false
+	} else {
+		var db *bolt.DB
+		if db, err = bolt.Open(absName, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout}); err == nil {
+			_ = db.Close()
+		} else if err == bolt.ErrTimeout {
+			locked = true
+		} else {
+			panic(err)
+		}
+	}
+
+	o, err := ReadOwner(absName)
+	if err != nil {
+		panic(err)
+	}
+	owner := px.Undef
+	alive := px.Undef
+	if o != nil {
+		owner = o.valueHash()
+		if a, known := o.Alive(); known {
+			alive = types.WrapBoolean(a)
+		}
+	}
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`db`, types.WrapString(absName)),
+		types.WrapHashEntry2(`exists`, types.WrapBoolean(exists)),
+		types.WrapHashEntry2(`locked`, types.WrapBoolean(locked)),
+		types.WrapHashEntry2(`owner`, owner),
+		types.WrapHashEntry2(`alive`, alive)})
+}
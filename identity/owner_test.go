@@ -0,0 +1,79 @@
+package identity
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestOwner(t *testing.T) {
+	filename := "TestOwner.db"
+	deleteFile(filename)
+	deleteFile(OwnerFile(filename))
+	defer deleteFile(filename)
+	defer deleteFile(OwnerFile(filename))
+
+	o, err := ReadOwner(filename)
+	require.NoError(t, err)
+	require.Nil(t, o)
+
+	require.NoError(t, writeOwner(filename, 0600))
+	fi, err := os.Stat(OwnerFile(filename))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	o, err = ReadOwner(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), o.PID)
+	require.Equal(t, Version, o.Version)
+	alive, known := o.Alive()
+	require.True(t, known)
+	require.True(t, alive)
+
+	o.Host = `some.other.host`
+	_, known = o.Alive()
+	require.False(t, known)
+
+	removeOwner(filename)
+	o, err = ReadOwner(filename)
+	require.NoError(t, err)
+	require.Nil(t, o)
+}
+
+func TestStatusOfLockedStore(t *testing.T) {
+	filename := "TestStatusOfLockedStore.db"
+	deleteFile(filename)
+	deleteFile(OwnerFile(filename))
+	defer deleteFile(filename)
+	defer deleteFile(OwnerFile(filename))
+
+	s := Status(filename, 100*time.Millisecond)
+	require.Equal(t, `false`, s.Get5(`exists`, nil).String())
+	require.Equal(t, `undef`, s.Get5(`owner`, nil).String())
+
+	db, err := bolt.Open(filename, 0600, nil)
+	require.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	require.NoError(t, writeOwner(filename, 0600))
+
+	s = Status(filename, 100*time.Millisecond)
+	require.Equal(t, `true`, s.Get5(`exists`, nil).String())
+	require.Equal(t, `true`, s.Get5(`locked`, nil).String())
+	require.Equal(t, `true`, s.Get5(`alive`, nil).String())
+
+	o := DefaultOptions()
+	o.DB = filename
+	o.Timeout = 100 * time.Millisecond
+	defer func() {
+		msg := fmt.Sprint(recover())
+		require.True(t, strings.Contains(msg, fmt.Sprintf("Owner is pid %d", os.Getpid())), msg)
+		require.True(t, strings.HasSuffix(msg, `(running)`), msg)
+	}()
+	NewIdentityWithOptions(o)
+}
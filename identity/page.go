@@ -0,0 +1,162 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MaxPageLimit is the highest limit accepted by SearchPage and GarbagePage
+var MaxPageLimit int64 = 10000
+
+// SearchPage is a paginated form of SearchFiltered. It returns at most limit tuples keyed by an internalID
+// prefixed by internalIDPrefix that pass the filter, starting after the position given by token. An empty token
+// starts from the beginning. The limit must be between 1 and MaxPageLimit.
+//
+// The result is a Hash with the entries tuples and next where next is the token to pass to obtain the next
+// page, or an empty string when there are no more tuples. Tuples are returned in internal ID order. Because the
+// position is a key rather than an index, concurrent writes never cause a page to skip or repeat a tuple that
+// was present during the whole pagination.
+func (i *identity) SearchPage(_ px.Context, internalIDPrefix string, filter px.OrderedMap, limit int64, token string) px.OrderedMap {
+	after := decodeToken(`search`, internalIDPrefix, token)
+	checkLimit(limit)
+	f := parseFilter(filter)
+
+	var found []px.Value
+	var next string
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			prefix := []byte(internalIDPrefix)
+			found, next = readPage(tx.Bucket(internalToExternal).Cursor(), prefix, after, int(limit),
+				func(k, v []byte) (px.Value, bool) {
+					if !bytes.HasPrefix(k, prefix) {
+						return nil, false
+					}
+					if t := unmarshalTuple(v); f.matches(t) {
+						return t.ValueTuple(), true
+					}
+					return nil, true
+				})
+			if next != `` {
+				next = encodeToken(`search`, internalIDPrefix, next)
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return pageHash(found, next)
+}
+
+// GarbagePage is a paginated form of GarbageFiltered. It returns at most limit tuples from the garbage bin that
+// belong to the workflow with the given prefix and pass the filter, starting after the position given by token.
+// An empty token starts from the beginning.
+//
+// The result is a Hash with the entries tuples and next as described for SearchPage. Tuples are returned in
+// external ID order.
+func (i *identity) GarbagePage(_ px.Context, internalIDPrefix string, filter px.OrderedMap, limit int64, token string) px.OrderedMap {
+	after := decodeToken(`garbage`, internalIDPrefix, token)
+	checkLimit(limit)
+	f := parseFilter(filter)
+
+	var found []px.Value
+	var next string
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			era := i.readMetadata(tx).Era
+			prefixes, err := i.buildReferences(tx, era, internalIDPrefix)
+			if err != nil {
+				return err
+			}
+
+			found, next = readPage(tx.Bucket(garbage).Cursor(), nil, after, int(limit),
+				func(k, v []byte) (px.Value, bool) {
+					t := unmarshalTuple(v)
+					if !f.matchesGarbage(t) {
+						return nil, true
+					}
+					for _, pfx := range prefixes {
+						if strings.HasPrefix(t.InternalID, pfx) {
+							return t.ValueTuple(), true
+						}
+					}
+					return nil, true
+				})
+			if next != `` {
+				next = encodeToken(`garbage`, internalIDPrefix, next)
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return pageHash(found, next)
+}
+
+// readPage reads at most limit values using the given cursor, starting at the first key that is greater than
+// or equal to start and greater than after. The match function returns the value for an entry, or nil to skip
+// it, and false to end the iteration. The returned next is the key of the last value when more values follow.
+func readPage(c *bolt.Cursor, start, after []byte, limit int, match func(k, v []byte) (px.Value, bool)) ([]px.Value, string) {
+	found := make([]px.Value, 0, limit)
+	k, v := c.Seek(start)
+	if after != nil && bytes.Compare(after, start) >= 0 {
+		k, v = c.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+	}
+
+	var last []byte
+	for ; k != nil; k, v = c.Next() {
+		pv, ok := match(k, v)
+		if !ok {
+			break
+		}
+		if pv == nil {
+			continue
+		}
+		if len(found) == limit {
+			// At least one more value exists
+			return found, string(last)
+		}
+		found = append(found, pv)
+		last = k
+	}
+	return found, ``
+}
+
+func pageHash(found []px.Value, next string) px.OrderedMap {
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`tuples`, types.WrapValues(found)),
+		types.WrapHashEntry2(`next`, types.WrapString(next))})
+}
+
+func checkLimit(limit int64) {
+	if limit <= 0 || limit > MaxPageLimit {
+		panic(errorf("page limit must be between 1 and %d, got %d", MaxPageLimit, limit))
+	}
+}
+
+// encodeToken returns an opaque continuation token for the given position of a paginated operation
+func encodeToken(op, prefix, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(op + "\x00" + prefix + "\x00" + key))
+}
+
+// decodeToken returns the position of the given continuation token, or nil when the token is empty. It is an
+// error if the token was not produced by the same operation and prefix.
+func decodeToken(op, prefix, token string) []byte {
+	if token == `` {
+		return nil
+	}
+	head := op + "\x00" + prefix + "\x00"
+	if bs, err := base64.RawURLEncoding.DecodeString(token); err == nil && strings.HasPrefix(string(bs), head) {
+		return bs[len(head):]
+	}
+	panic(errorf("invalid continuation token '%s' for %s of '%s'", token, op, prefix))
+}
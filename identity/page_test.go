@@ -0,0 +1,83 @@
+package identity
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+// pageIDs returns the internal IDs of the tuples of a page and its next token
+func pageIDs(page px.OrderedMap) ([]string, string) {
+	tuples := page.Get5(`tuples`, nil).(px.List)
+	ids := make([]string, tuples.Len())
+	tuples.EachWithIndex(func(t px.Value, ix int) { ids[ix] = t.(px.List).At(0).String() })
+	return ids, page.Get5(`next`, nil).String()
+}
+
+func TestSearchPage(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSearchPage.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		for n := 5; n > 0; n-- {
+			id.Associate(c, fmt.Sprintf("a:i%d", n), fmt.Sprintf("e%d", n))
+		}
+		id.Associate(c, "b:i1", "e6")
+
+		ids, next := pageIDs(id.SearchPage(c, "a:", nil, 2, ``))
+		require.Equal(t, []string{"a:i1", "a:i2"}, ids)
+
+		// Concurrent writes before and after the position
+		id.Associate(c, "a:i0", "e0")
+		id.RemoveInternal(c, "a:i2")
+		id.Associate(c, "a:i4a", "e4a")
+
+		ids, next = pageIDs(id.SearchPage(c, "a:", nil, 2, next))
+		require.Equal(t, []string{"a:i3", "a:i4"}, ids)
+		ids, next = pageIDs(id.SearchPage(c, "a:", nil, 2, next))
+		require.Equal(t, []string{"a:i4a", "a:i5"}, ids)
+		require.Equal(t, ``, next)
+
+		ids, next = pageIDs(id.SearchPage(c, "a:", nil, 10, ``))
+		require.Equal(t, 6, len(ids))
+		require.Equal(t, ``, next)
+
+		_, next = pageIDs(id.SearchPage(c, "a:", nil, 1, ``))
+		require.Panics(t, func() { id.SearchPage(c, "b:", nil, 1, next) })
+		require.Panics(t, func() { id.GarbagePage(c, "a:", nil, 1, next) })
+		require.Panics(t, func() { id.SearchPage(c, "a:", nil, 1, `not a token`) })
+		require.Panics(t, func() { id.SearchPage(c, "a:", nil, 0, ``) })
+		require.Panics(t, func() { id.GarbagePage(c, "a:", nil, 1<<40, ``) })
+	})
+}
+
+func TestGarbagePage(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestGarbagePage.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		for n := 1; n <= 4; n++ {
+			id.Associate(c, fmt.Sprintf("a:i%d", n), fmt.Sprintf("e%d", n))
+			id.Associate(c, fmt.Sprintf("b:i%d", n), fmt.Sprintf("f%d", n))
+		}
+		id.BumpEra(c)
+		id.Sweep(c, "a:")
+		id.Sweep(c, "b:")
+
+		ids, next := pageIDs(id.GarbagePage(c, "a:", nil, 3, ``))
+		require.Equal(t, []string{"a:i1", "a:i2", "a:i3"}, ids)
+		ids, next = pageIDs(id.GarbagePage(c, "a:", nil, 3, next))
+		require.Equal(t, []string{"a:i4"}, ids)
+		require.Equal(t, ``, next)
+
+		ids, _ = pageIDs(id.GarbagePage(c, "", nil, 100, ``))
+		require.Equal(t, id.Garbage(c, "").Len(), len(ids))
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package identity
+
+import "syscall"
+
+// processAlive returns true if a process with the given pid exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package identity
+
+import "syscall"
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+)
+
+// processAlive returns true if a process with the given pid exists
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = syscall.CloseHandle(h)
+	}()
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
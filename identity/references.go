@@ -0,0 +1,109 @@
+package identity
+
+import (
+	"strings"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// OrphanReferences finds all references whose target workflow no longer has any mappings, neither in the store
+// nor in the garbage bin. A target workflow that has no mappings of its own but references a workflow that does
+// is not considered orphaned. The orphaned references are deleted when purge is true.
+//
+// Each reference is a seven element array as described for ValueTuple where InternalID is the referencing
+// internal ID and ExternalID is the referenced prefix.
+//
+// The references are returned in the order they were added to the store. An empty slice is returned when no
+// orphaned references are found.
+func (i *identity) OrphanReferences(_ px.Context, purge bool) px.List {
+	orphans := make([]px.Value, 0, 8)
+	i.withDb(func(db *bolt.DB) {
+		find := func(tx *bolt.Tx) error {
+			var purged []*reference
+			refs, err := readReferences(tx, func(*reference) bool { return true })
+			if err != nil {
+				return err
+			}
+			ids, err := mappedInternalIDs(tx)
+			if err != nil {
+				return err
+			}
+
+			alive := livePrefixes(refs, ids)
+			for _, ref := range refs {
+				if alive[ref.ExternalID] {
+					continue
+				}
+				if purge {
+					deleteFromBucket(tx, references, refKey(ref.InternalID, ref.ExternalID))
+					purged = append(purged, ref)
+					onCommit(tx, i.log.Debug, "purged orphaned reference", "internalId", ref.InternalID, "prefix", ref.ExternalID)
+				}
+				orphans = append(orphans, ref.ValueTuple())
+			}
+			if purge {
+				i.audit(tx, `orphanReferences`, purged)
+			}
+			return nil
+		}
+
+		var err error
+		if purge {
+			err = db.Update(find)
+		} else {
+			err = db.View(find)
+		}
+		if err != nil {
+			panic(err)
+		}
+	})
+	return types.WrapValues(orphans)
+}
+
+// mappedInternalIDs returns the internal IDs of all tuples in the store and in the garbage bin
+func mappedInternalIDs(tx *bolt.Tx) ([]string, error) {
+	ids := make([]string, 0, 64)
+	err := tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	})
+	if err == nil {
+		err = tx.Bucket(garbage).ForEach(func(k, v []byte) error {
+			ids = append(ids, unmarshalTuple(v).InternalID)
+			return nil
+		})
+	}
+	return ids, err
+}
+
+// livePrefixes returns the set of referenced prefixes for which a mapping exists or that reference, directly or
+// transitively, a prefix for which that is true
+func livePrefixes(refs []*reference, ids []string) map[string]bool {
+	alive := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		for _, id := range ids {
+			if strings.HasPrefix(id, ref.ExternalID) {
+				alive[ref.ExternalID] = true
+				break
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, ref := range refs {
+			if !alive[ref.ExternalID] {
+				continue
+			}
+			for _, other := range refs {
+				if !alive[other.ExternalID] && strings.HasPrefix(ref.InternalID, other.ExternalID) {
+					alive[other.ExternalID] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return alive
+}
@@ -0,0 +1,48 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrphanReferences(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestOrphanReferences.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.AddReference(c, "a:i2", "b:")
+		id.Associate(c, "b:i1", "e2")
+		id.AddReference(c, "a:i3", "c:")
+		id.AddReference(c, "c:i1", "d:")
+		id.Associate(c, "d:i1", "e3")
+		id.AddReference(c, "a:i4", "x:")
+		id.Associate(c, "y:i1", "e4")
+
+		orphans := id.OrphanReferences(c, false)
+		require.EqualValues(t, 1, orphans.Len())
+		require.Equal(t, "x:", orphans.At(0).(px.List).At(1).String())
+
+		// Garbage keeps the target alive
+		id.RemoveInternal(c, "b:i1")
+		require.EqualValues(t, 1, id.OrphanReferences(c, false).Len())
+
+		// Purged target, and intermediate workflow referencing it, are orphaned
+		id.PurgeInternal(c, "b:i1")
+		id.PurgeInternal(c, "d:i1")
+		orphans = id.OrphanReferences(c, true)
+		require.EqualValues(t, 4, orphans.Len())
+		require.Equal(t, "b:", orphans.At(0).(px.List).At(1).String())
+		require.Equal(t, "c:", orphans.At(1).(px.List).At(1).String())
+		require.Equal(t, "d:", orphans.At(2).(px.List).At(1).String())
+		require.Equal(t, "x:", orphans.At(3).(px.List).At(1).String())
+
+		require.EqualValues(t, 0, id.OrphanReferences(c, false).Len())
+		require.Equal(t, "{\n  \"nodes\": [],\n  \"edges\": []\n}", id.ReferenceGraph(c, "", "json"))
+	})
+}
@@ -0,0 +1,101 @@
+package identity
+
+import (
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// nextSeq increments the sequence of the store and returns the new value. Sequence numbers give tuples and
+// references a total order that reflects the order in which they were added to the store.
+func (i *identity) nextSeq(tx *bolt.Tx) int64 {
+	md := i.readMetadata(tx)
+	md.Seq++
+	putInBucket(tx, metadata, metadata, marshalMetadata(md))
+	return md.Seq
+}
+
+// assignSequences gives every tuple and reference in the store a sequence number in the order of their
+// timestamps and returns the highest number assigned. Used when upgrading a store to version 1.2.0
+func assignSequences(tx *bolt.Tx) (int64, error) {
+	type record struct {
+		bucket []byte
+		key    []byte
+		t      *tuple
+	}
+	var rs []*record
+	for _, bn := range [][]byte{internalToExternal, garbage, references} {
+		bn := bn
+		err := tx.Bucket(bn).ForEach(func(k, v []byte) error {
+			rs = append(rs, &record{bucket: bn, key: append([]byte{}, k...), t: unmarshalTuple(v)})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.SliceStable(rs, func(i, j int) bool {
+		return rs[i].t.Timestamp.Before(rs[j].t.Timestamp)
+	})
+	for ix, r := range rs {
+		r.t.Seq = int64(ix + 1)
+		putInBucket(tx, r.bucket, r.key, marshalTuple(r.t))
+	}
+	return int64(len(rs)), nil
+}
+
+// assignTimes sets the association and seen times of every tuple and reference in the store to the time it was
+// created where they are unset. Used when upgrading a store to version 1.3.0
+func assignTimes(tx *bolt.Tx) error {
+	for _, bn := range [][]byte{internalToExternal, garbage, references} {
+		var keys [][]byte
+		var ts []*tuple
+		err := tx.Bucket(bn).ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			ts = append(ts, unmarshalTuple(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for ix, t := range ts {
+			t.defaultTimes()
+			putInBucket(tx, bn, keys[ix], marshalTuple(t))
+		}
+	}
+	return nil
+}
+
+// defaultTimes sets the association and seen times of the tuple to the time it was created unless they are set
+func (t *tuple) defaultTimes() {
+	if t.Associated.IsZero() {
+		t.Associated = t.Timestamp
+	}
+	if t.Seen.IsZero() {
+		t.Seen = t.Timestamp
+	}
+}
+
+// assignCollected sets the time when each tuple in the garbage bin was collected to the time it was last seen,
+// which is the closest time known for stores that did not record it
+func assignCollected(tx *bolt.Tx) error {
+	var keys [][]byte
+	var ts []*tuple
+	err := tx.Bucket(garbage).ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		ts = append(ts, unmarshalTuple(v))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for ix, t := range ts {
+		if t.Collected == nil {
+			seen := t.Seen
+			t.Collected = &seen
+			putInBucket(tx, garbage, keys[ix], marshalTuple(t))
+		}
+	}
+	return nil
+}
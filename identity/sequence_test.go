@@ -0,0 +1,200 @@
+package identity
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSequenceOrder(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSequenceOrder.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		expected := make([]string, 20)
+		for n := 0; n < 20; n++ {
+			// Internal IDs in descending key order so that key order differs from insertion order
+			expected[n] = fmt.Sprintf("a:i%02d", 20-n)
+			id.Associate(c, expected[n], fmt.Sprintf("e%d", n))
+		}
+		found := id.Search(c, "a:")
+		require.Equal(t, expected, tupleIDs(found))
+		found.EachWithIndex(func(t1 px.Value, ix int) {
+			require.EqualValues(t, ix+1, t1.(px.List).At(4).(px.Integer).Int())
+		})
+
+		id.AddReference(c, "a:i01", "b:")
+		refs := id.OrphanReferences(c, false)
+		require.EqualValues(t, 21, refs.At(0).(px.List).At(4).(px.Integer).Int())
+	})
+}
+
+func TestSequenceMigration(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestSequenceMigration.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		now := time.Now()
+		corrupt(filename, func(tx *bolt.Tx) error {
+			for _, bn := range allBuckets {
+				if _, err := tx.CreateBucket(bn); err != nil {
+					return err
+				}
+			}
+			putInBucket(tx, metadata, metadata, marshalMetadata(&storeMeta{Version: `1.1.0`, Timestamp: now}))
+			for ix, iid := range []string{`a:i3`, `a:i1`, `a:i2`} {
+				eid := fmt.Sprintf("e%d", ix)
+				putInBucket(tx, internalToExternal, []byte(iid),
+					marshalTuple(&tuple{InternalID: iid, ExternalID: eid, Timestamp: now.Add(time.Duration(ix) * time.Second)}))
+				putInBucket(tx, externalToInternal, []byte(eid), []byte(iid))
+			}
+			putInBucket(tx, references, refKey(`a:i1`, `b:`),
+				marshalReference(&reference{InternalID: `a:i1`, ExternalID: `b:`, Timestamp: now.Add(time.Minute)}))
+			return nil
+		})
+
+		id := NewIdentity(filename)
+		require.Equal(t, []string{`a:i3`, `a:i1`, `a:i2`}, tupleIDs(id.Search(c, "a:")))
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+		require.Contains(t, id.Export(c, `json`), `"version": "`+identityStoreVersion.String()+`"`)
+
+		id.Associate(c, "a:i4", "e4")
+		require.EqualValues(t, 5, id.Search(c, "a:i4").At(0).(px.List).At(4).(px.Integer).Int())
+	})
+}
+
+func TestStaleSequence(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStaleSequence.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+
+		corrupt(filename, func(tx *bolt.Tx) error {
+			md := unmarshalMetadata(tx.Bucket(metadata).Get(metadata))
+			md.Seq = 1
+			putInBucket(tx, metadata, metadata, marshalMetadata(md))
+			return nil
+		})
+		require.Equal(t, []string{`staleSequence`}, problemKinds(id.Verify(c, true)))
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+
+		id.Associate(c, "a:i3", "e3")
+		require.EqualValues(t, 3, id.Search(c, "a:i3").At(0).(px.List).At(4).(px.Integer).Int())
+	})
+}
+
+func tupleTime(t px.Value, ix int) time.Time {
+	return t.(px.List).At(ix).(*types.Timestamp).Time()
+}
+
+func TestTupleTimes(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestTupleTimes.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		t1 := id.Search(c, "a:i1").At(0)
+		created := tupleTime(t1, 2)
+		require.Equal(t, created, tupleTime(t1, 5))
+		require.Equal(t, created, tupleTime(t1, 6))
+
+		// Raising the era only touches the seen time
+		time.Sleep(2 * time.Millisecond)
+		id.BumpEra(c)
+		id.GetExternal(c, "a:i1")
+		t1 = id.Search(c, "a:i1").At(0)
+		require.Equal(t, created, tupleTime(t1, 2))
+		require.Equal(t, created, tupleTime(t1, 5))
+		seen := tupleTime(t1, 6)
+		require.True(t, seen.After(created))
+
+		// Re-association touches both the associated and the seen time
+		time.Sleep(2 * time.Millisecond)
+		id.Associate(c, "a:i1", "e1")
+		t1 = id.Search(c, "a:i1").At(0)
+		require.Equal(t, created, tupleTime(t1, 2))
+		require.True(t, tupleTime(t1, 5).After(seen))
+		require.Equal(t, tupleTime(t1, 5), tupleTime(t1, 6))
+
+		// Times are kept when the tuple is moved to the garbage bin
+		id.RemoveInternal(c, "a:i1")
+		g := id.Garbage(c, "a:").At(0)
+		require.Equal(t, tupleTime(t1, 5), tupleTime(g, 5))
+	})
+}
+
+func TestTimesMigration(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestTimesMigration.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		now := time.Now()
+		corrupt(filename, func(tx *bolt.Tx) error {
+			for _, bn := range allBuckets {
+				if _, err := tx.CreateBucket(bn); err != nil {
+					return err
+				}
+			}
+			putInBucket(tx, metadata, metadata, marshalMetadata(&storeMeta{Version: `1.2.0`, Timestamp: now, Seq: 2}))
+			putInBucket(tx, internalToExternal, []byte(`a:i1`),
+				marshalTuple(&tuple{InternalID: `a:i1`, ExternalID: `e1`, Timestamp: now, Seq: 1}))
+			putInBucket(tx, externalToInternal, []byte(`e1`), []byte(`a:i1`))
+			putInBucket(tx, garbage, []byte(`e2`),
+				marshalTuple(&tuple{InternalID: `a:i2`, ExternalID: `e2`, Timestamp: now.Add(time.Second), Seq: 2}))
+			return nil
+		})
+
+		id := NewIdentity(filename)
+		t1 := id.Search(c, "a:").At(0)
+		require.True(t, now.Equal(tupleTime(t1, 5)))
+		require.True(t, now.Equal(tupleTime(t1, 6)))
+		g := id.Garbage(c, "a:").At(0)
+		require.True(t, now.Add(time.Second).Equal(tupleTime(g, 6)))
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+		require.Contains(t, id.Export(c, `json`), `"version": "`+identityStoreVersion.String()+`"`)
+	})
+}
+
+func TestCollectedMigration(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestCollectedMigration.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+
+		created := time.Now().Add(-time.Hour)
+		seen := created.Add(time.Minute)
+		corrupt(filename, func(tx *bolt.Tx) error {
+			for _, bn := range allBuckets {
+				if _, err := tx.CreateBucket(bn); err != nil {
+					return err
+				}
+			}
+			putInBucket(tx, metadata, metadata, marshalMetadata(&storeMeta{Version: `1.6.0`, Timestamp: created, Seq: 1}))
+			putInBucket(tx, garbage, []byte(`e1`), marshalTuple(&tuple{InternalID: `a:i1`, ExternalID: `e1`,
+				Timestamp: created, Seq: 1, Associated: created, Seen: seen}))
+			return nil
+		})
+
+		id := NewIdentity(filename)
+		after := filterHash(map[string]px.Value{`after`: types.WrapString(seen.Format(time.RFC3339Nano))})
+		require.Equal(t, []string{"a:i1"}, tupleIDs(id.GarbageFiltered(c, "a:", after)))
+		before := filterHash(map[string]px.Value{`before`: types.WrapString(seen.Format(time.RFC3339Nano))})
+		require.Equal(t, 0, id.GarbageFiltered(c, "a:", before).Len())
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+	})
+}
@@ -0,0 +1,143 @@
+package identity
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// tupleStats accumulates the statistics of tuples
+type tupleStats struct {
+	mappings   int64
+	garbage    int64
+	references int64
+	eras       map[int64][2]int64
+	oldest     time.Time
+	newest     time.Time
+}
+
+// Stats returns statistics about the mappings, garbage entries, and references whose internal ID has the given
+// prefix along with statistics about the store file. References are not expanded.
+//
+// The result is a Hash with the entries prefix, currentEra, mappings, garbage, references, eras, oldest, newest,
+// and file. The eras entry is a Hash keyed by GC era, in ascending order, where each value is a Hash with the
+// number of mappings and garbage entries in that era. The oldest and newest entries are the timestamps of the
+// oldest and newest mapping or garbage entry and are undefined when no such entry exists. The file entry is a
+// Hash with the size and pageSize of the file, the number of freePages and pendingPages, and a buckets entry
+// with the keys, depth, branchPages, leafPages, and leafInuse bytes of each bucket.
+func (i *identity) Stats(_ px.Context, internalIDPrefix string) (result px.OrderedMap) {
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			s := &tupleStats{eras: make(map[int64][2]int64)}
+			err := tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+				if strings.HasPrefix(string(k), internalIDPrefix) {
+					s.mappings++
+					s.add(unmarshalTuple(v), 0)
+				}
+				return nil
+			})
+			if err == nil {
+				err = tx.Bucket(garbage).ForEach(func(k, v []byte) error {
+					if t := unmarshalTuple(v); strings.HasPrefix(t.InternalID, internalIDPrefix) {
+						s.garbage++
+						s.add(t, 1)
+					}
+					return nil
+				})
+			}
+			if err == nil {
+				err = tx.Bucket(references).ForEach(func(k, v []byte) error {
+					if strings.HasPrefix(unmarshalReference(v).InternalID, internalIDPrefix) {
+						s.references++
+					}
+					return nil
+				})
+			}
+			if err != nil {
+				return err
+			}
+
+			es := make([]*types.HashEntry, 0, 10)
+			es = append(es, types.WrapHashEntry2(`prefix`, types.WrapString(internalIDPrefix)))
+			es = append(es, types.WrapHashEntry2(`currentEra`, types.WrapInteger(i.readMetadata(tx).Era)))
+			es = append(es, types.WrapHashEntry2(`mappings`, types.WrapInteger(s.mappings)))
+			es = append(es, types.WrapHashEntry2(`garbage`, types.WrapInteger(s.garbage)))
+			es = append(es, types.WrapHashEntry2(`references`, types.WrapInteger(s.references)))
+			es = append(es, types.WrapHashEntry2(`eras`, s.eraHash()))
+			es = append(es, types.WrapHashEntry2(`oldest`, timestampOrUndef(s.oldest)))
+			es = append(es, types.WrapHashEntry2(`newest`, timestampOrUndef(s.newest)))
+			es = append(es, types.WrapHashEntry2(`file`, fileStats(db, tx)))
+			result = types.WrapHash(es)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return
+}
+
+// add counts the tuple in the era distribution, using index 0 for mappings and 1 for garbage, and updates the
+// oldest and newest timestamps
+func (s *tupleStats) add(t *tuple, index int) {
+	c := s.eras[t.Era]
+	c[index]++
+	s.eras[t.Era] = c
+	if s.oldest.IsZero() || t.Timestamp.Before(s.oldest) {
+		s.oldest = t.Timestamp
+	}
+	if t.Timestamp.After(s.newest) {
+		s.newest = t.Timestamp
+	}
+}
+
+func (s *tupleStats) eraHash() px.OrderedMap {
+	eras := make([]int64, 0, len(s.eras))
+	for era := range s.eras {
+		eras = append(eras, era)
+	}
+	sort.Slice(eras, func(i, j int) bool { return eras[i] < eras[j] })
+
+	es := make([]*types.HashEntry, len(eras))
+	for ix, era := range eras {
+		c := s.eras[era]
+		es[ix] = types.WrapHashEntry(types.WrapInteger(era), types.WrapHash([]*types.HashEntry{
+			types.WrapHashEntry2(`mappings`, types.WrapInteger(c[0])),
+			types.WrapHashEntry2(`garbage`, types.WrapInteger(c[1]))}))
+	}
+	return types.WrapHash(es)
+}
+
+// fileStats returns a Hash with statistics about the Bolt file and its buckets
+func fileStats(db *bolt.DB, tx *bolt.Tx) px.OrderedMap {
+	ds := db.Stats()
+	bs := make([]*types.HashEntry, 0, len(allBuckets))
+	for _, bn := range allBuckets {
+		if b := tx.Bucket(bn); b != nil {
+			st := b.Stats()
+			bs = append(bs, types.WrapHashEntry2(string(bn), types.WrapHash([]*types.HashEntry{
+				types.WrapHashEntry2(`keys`, types.WrapInteger(int64(st.KeyN))),
+				types.WrapHashEntry2(`depth`, types.WrapInteger(int64(st.Depth))),
+				types.WrapHashEntry2(`branchPages`, types.WrapInteger(int64(st.BranchPageN))),
+				types.WrapHashEntry2(`leafPages`, types.WrapInteger(int64(st.LeafPageN))),
+				types.WrapHashEntry2(`leafInuse`, types.WrapInteger(int64(st.LeafInuse)))})))
+		}
+	}
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`size`, types.WrapInteger(tx.Size())),
+		types.WrapHashEntry2(`pageSize`, types.WrapInteger(int64(db.Info().PageSize))),
+		types.WrapHashEntry2(`freePages`, types.WrapInteger(int64(ds.FreePageN))),
+		types.WrapHashEntry2(`pendingPages`, types.WrapInteger(int64(ds.PendingPageN))),
+		types.WrapHashEntry2(`buckets`, types.WrapHash(bs))})
+}
+
+func timestampOrUndef(t time.Time) px.Value {
+	if t.IsZero() {
+		return px.Undef
+	}
+	return types.WrapTimestamp(t)
+}
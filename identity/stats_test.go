@@ -0,0 +1,50 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStats.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		s := id.Stats(c, "a:")
+		require.EqualValues(t, 0, s.Get5(`mappings`, nil).(px.Integer).Int())
+		require.Equal(t, `undef`, s.Get5(`oldest`, nil).String())
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.Associate(c, "b:i1", "e3")
+		id.AddReference(c, "a:i1", "b:")
+		id.BumpEra(c)
+		id.Associate(c, "a:i3", "e4")
+		id.RemoveInternal(c, "a:i2")
+
+		s = id.Stats(c, "a:")
+		require.EqualValues(t, 2, s.Get5(`mappings`, nil).(px.Integer).Int())
+		require.EqualValues(t, 1, s.Get5(`garbage`, nil).(px.Integer).Int())
+		require.EqualValues(t, 1, s.Get5(`references`, nil).(px.Integer).Int())
+		require.EqualValues(t, 1, s.Get5(`currentEra`, nil).(px.Integer).Int())
+		require.Equal(t, `{0 => {'mappings' => 1, 'garbage' => 1}, 1 => {'mappings' => 1, 'garbage' => 0}}`, s.Get5(`eras`, nil).String())
+
+		oldest := s.Get5(`oldest`, nil).(*types.Timestamp).Time()
+		newest := s.Get5(`newest`, nil).(*types.Timestamp).Time()
+		require.True(t, oldest.Before(newest))
+
+		file := s.Get5(`file`, nil).(px.OrderedMap)
+		require.True(t, file.Get5(`size`, nil).(px.Integer).Int() > 0)
+		buckets := file.Get5(`buckets`, nil).(px.OrderedMap)
+		require.EqualValues(t, 3, buckets.Get5(`internalToExternal`, nil).(px.OrderedMap).Get5(`keys`, nil).(px.Integer).Int())
+
+		s = id.Stats(c, "")
+		require.EqualValues(t, 3, s.Get5(`mappings`, nil).(px.Integer).Int())
+	})
+}
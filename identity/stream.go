@@ -0,0 +1,311 @@
+package identity
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// The functions in this file are served to remote clients by the streaming gRPC service of the plugin. See
+// StreamClient.
+
+// StreamBatchSize is the number of tuples that StreamSearch and StreamGarbage read from the store at a time
+var StreamBatchSize int64 = 256
+
+// StreamSearch calls yield with each tuple found by SearchFiltered, in internal ID order. Tuples are read in batches
+// using SearchPage so memory use is bounded and the store is not locked while yield runs. The iteration stops
+// when yield returns an error, which is then returned.
+func StreamSearch(c px.Context, s Service, internalIDPrefix string, filter px.OrderedMap, yield func(px.List) error) error {
+	return streamPages(func(token string) px.OrderedMap {
+		return s.SearchPage(c, internalIDPrefix, filter, StreamBatchSize, token)
+	}, yield)
+}
+
+// StreamGarbage calls yield with each tuple found by GarbageFiltered, in external ID order. Tuples are read in batches
+// the same way as for StreamSearch.
+func StreamGarbage(c px.Context, s Service, internalIDPrefix string, filter px.OrderedMap, yield func(px.List) error) error {
+	return streamPages(func(token string) px.OrderedMap {
+		return s.GarbagePage(c, internalIDPrefix, filter, StreamBatchSize, token)
+	}, yield)
+}
+
+func streamPages(page func(token string) px.OrderedMap, yield func(px.List) error) error {
+	token := ``
+	for {
+		p := page(token)
+		var err error
+		p.Get5(`tuples`, nil).(px.List).Find(func(t px.Value) bool {
+			err = yield(t.(px.List))
+			return err != nil
+		})
+		if err != nil {
+			return err
+		}
+		if token = p.Get5(`next`, nil).String(); token == `` {
+			return nil
+		}
+	}
+}
+
+// StreamWatch calls yield with each event returned by Watch, starting after the position given by token, along
+// with the token that resumes after that event. Each call to Watch waits up to wait milliseconds. The iteration
+// continues until yield returns an error, which is then returned.
+func StreamWatch(c px.Context, s Service, internalIDPrefix, token string, wait int64, yield func(event px.OrderedMap, token string) error) error {
+	for {
+		r := s.Watch(c, internalIDPrefix, token, wait)
+		var err error
+		r.Get5(`events`, nil).(px.List).Find(func(e px.Value) bool {
+			eh := e.(px.OrderedMap)
+			err = yield(eh, encodeToken(`watch`, internalIDPrefix, string(eventKey(uint64(eh.Get5(`seq`, nil).(px.Integer).Int())))))
+			return err != nil
+		})
+		if err != nil {
+			return err
+		}
+		token = r.Get5(`next`, nil).String()
+	}
+}
+
+// StreamExport writes the same document as Export to the given writer, one record at a time, so that the whole
+// document is never held in memory. The document is read in a single read transaction and is therefore a
+// consistent snapshot of the store. The service must have been created by NewIdentity or NewIdentityWithOptions.
+func StreamExport(s Service, w io.Writer, format string) error {
+	i, enc, err := exportEncoder(s, format)
+	if err != nil {
+		return err
+	}
+	i.withDb(func(db *bolt.DB) {
+		err = db.View(func(tx *bolt.Tx) error {
+			return writeDocument(w, enc, i.readMetadata(tx), func(bucket, after []byte) ([]*tuple, []byte) {
+				return readBatch(tx, bucket, after)
+			})
+		})
+	})
+	return err
+}
+
+// streamExportBatches is like StreamExport but reads the records in batches of StreamBatchSize, each in a read
+// transaction of its own, so the store is never held open while the writer blocks on a remote client. As with
+// SearchPage, records that are present during the whole export are written exactly once, but the document is
+// not a snapshot of a single moment.
+func streamExportBatches(s Service, w io.Writer, format string) error {
+	i, enc, err := exportEncoder(s, format)
+	if err != nil {
+		return err
+	}
+	var md *storeMeta
+	i.withDb(func(db *bolt.DB) {
+		err = db.View(func(tx *bolt.Tx) error {
+			md = i.readMetadata(tx)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeDocument(w, enc, md, func(bucket, after []byte) (ts []*tuple, last []byte) {
+		i.withDb(func(db *bolt.DB) {
+			err := db.View(func(tx *bolt.Tx) error {
+				ts, last = readBatch(tx, bucket, after)
+				return nil
+			})
+			if err != nil {
+				panic(err)
+			}
+		})
+		return
+	})
+}
+
+func exportEncoder(s Service, format string) (*identity, documentEncoder, error) {
+	i, ok := s.(*identity)
+	if !ok {
+		return nil, nil, errorf("StreamExport requires a service created by NewIdentity")
+	}
+	switch format {
+	case `json`:
+		return i, &jsonEncoder{}, nil
+	case `yaml`:
+		return i, &yamlEncoder{}, nil
+	default:
+		return nil, nil, errorf("unknown document format '%s'. Expected json or yaml", format)
+	}
+}
+
+// writeDocument writes a document with the given metadata and the records returned by readBatch to w
+func writeDocument(w io.Writer, enc documentEncoder, md *storeMeta, readBatch func(bucket, after []byte) ([]*tuple, []byte)) error {
+	bw := bufio.NewWriter(w)
+	err := enc.header(bw, &document{Version: md.Version, Era: md.Era, Timestamp: md.Timestamp})
+	for _, bn := range [][]byte{internalToExternal, garbage, references} {
+		first := true
+		var after []byte
+		for err == nil {
+			var ts []*tuple
+			ts, after = readBatch(bn, after)
+			if first {
+				err = enc.beginList(bw, documentKeys[string(bn)], len(ts) == 0)
+			}
+			for _, t := range ts {
+				if err == nil {
+					err = enc.item(bw, t, first)
+					first = false
+				}
+			}
+			if after == nil {
+				break
+			}
+		}
+		if err == nil {
+			err = enc.endList(bw, first)
+		}
+	}
+	if err == nil {
+		err = enc.end(bw)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return err
+}
+
+// readBatch reads at most StreamBatchSize records of the given bucket whose keys follow after, or that start the
+// bucket when after is nil. Returns the records and the key of the last one, or nil when no records follow.
+func readBatch(tx *bolt.Tx, bucket, after []byte) (ts []*tuple, last []byte) {
+	c := tx.Bucket(bucket).Cursor()
+	k, v := c.First()
+	if after != nil {
+		if k, v = c.Seek(after); bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+	}
+	for ; k != nil && int64(len(ts)) < StreamBatchSize; k, v = c.Next() {
+		ts = append(ts, unmarshalTuple(v))
+		last = append([]byte{}, k...)
+	}
+	if k == nil {
+		last = nil
+	}
+	return
+}
+
+// documentKeys maps bucket names to the corresponding document keys
+var documentKeys = map[string]string{
+	string(internalToExternal): `mappings`,
+	string(garbage):            `garbage`,
+	string(references):         `references`,
+}
+
+// A documentEncoder writes a document incrementally in the same form as document.encode
+type documentEncoder interface {
+	header(w io.Writer, d *document) error
+	beginList(w io.Writer, key string, empty bool) error
+	item(w io.Writer, t *tuple, first bool) error
+	endList(w io.Writer, empty bool) error
+	end(w io.Writer) error
+}
+
+type jsonEncoder struct{}
+
+func (*jsonEncoder) header(w io.Writer, d *document) error {
+	ts, err := json.Marshal(d.Timestamp)
+	if err == nil {
+		_, err = io.WriteString(w, "{\n  \"version\": "+quoteJSON(d.Version)+",\n  \"era\": "+jsonNumber(d.Era)+",\n  \"timestamp\": "+string(ts))
+	}
+	return err
+}
+
+func (*jsonEncoder) beginList(w io.Writer, key string, empty bool) error {
+	s := ",\n  " + quoteJSON(key) + ": ["
+	if empty {
+		s += "]"
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func (*jsonEncoder) item(w io.Writer, t *tuple, first bool) error {
+	bs, err := json.MarshalIndent(t, `    `, `  `)
+	if err != nil {
+		return err
+	}
+	sep := ",\n    "
+	if first {
+		sep = "\n    "
+	}
+	if _, err = io.WriteString(w, sep); err == nil {
+		_, err = w.Write(bs)
+	}
+	return err
+}
+
+func (*jsonEncoder) endList(w io.Writer, empty bool) error {
+	if empty {
+		return nil
+	}
+	_, err := io.WriteString(w, "\n  ]")
+	return err
+}
+
+func (*jsonEncoder) end(w io.Writer) error {
+	_, err := io.WriteString(w, "\n}")
+	return err
+}
+
+func quoteJSON(s string) string {
+	bs, _ := json.Marshal(s)
+	return string(bs)
+}
+
+func jsonNumber(n int64) string {
+	bs, _ := json.Marshal(n)
+	return string(bs)
+}
+
+type yamlEncoder struct{}
+
+func (*yamlEncoder) header(w io.Writer, d *document) error {
+	bs, err := yaml.Marshal(&struct {
+		Version   string    `yaml:"version"`
+		Era       int64     `yaml:"era"`
+		Timestamp time.Time `yaml:"timestamp"`
+	}{d.Version, d.Era, d.Timestamp})
+	if err == nil {
+		_, err = w.Write(bs)
+	}
+	return err
+}
+
+func (*yamlEncoder) beginList(w io.Writer, key string, empty bool) error {
+	s := key + ":"
+	if empty {
+		s += " []"
+	}
+	_, err := io.WriteString(w, s+"\n")
+	return err
+}
+
+func (*yamlEncoder) item(w io.Writer, t *tuple, _ bool) error {
+	bs, err := yaml.Marshal([]*tuple{t})
+	if err != nil {
+		return err
+	}
+	// Indent the single element sequence to make it part of the list
+	bs = bytes.TrimSuffix(bs, []byte("\n"))
+	bs = append([]byte(`  `), bytes.Replace(bs, []byte("\n"), []byte("\n  "), -1)...)
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+func (*yamlEncoder) endList(io.Writer, bool) error {
+	return nil
+}
+
+func (*yamlEncoder) end(io.Writer) error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamSearch(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStreamSearch.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		saved := StreamBatchSize
+		StreamBatchSize = 2
+		defer func() { StreamBatchSize = saved }()
+
+		for n := 1; n <= 5; n++ {
+			id.Associate(c, fmt.Sprintf("a:i%d", n), fmt.Sprintf("e%d", n))
+		}
+		id.Associate(c, "b:i1", "f1")
+
+		var ids []string
+		require.NoError(t, StreamSearch(c, id, "a:", nil, func(t px.List) error {
+			ids = append(ids, t.At(0).String())
+			return nil
+		}))
+		require.Equal(t, []string{"a:i1", "a:i2", "a:i3", "a:i4", "a:i5"}, ids)
+
+		stop := errors.New("stop")
+		n := 0
+		require.Equal(t, stop, StreamSearch(c, id, "a:", nil, func(t px.List) error {
+			if n++; n == 3 {
+				return stop
+			}
+			return nil
+		}))
+		require.Equal(t, 3, n)
+
+		id.BumpEra(c)
+		id.Sweep(c, "a:")
+		ids = nil
+		require.NoError(t, StreamGarbage(c, id, "a:", nil, func(t px.List) error {
+			ids = append(ids, t.At(0).String())
+			return nil
+		}))
+		require.Equal(t, []string{"a:i1", "a:i2", "a:i3", "a:i4", "a:i5"}, ids)
+	})
+}
+
+func TestStreamExport(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStreamExport.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		for _, format := range []string{`json`, `yaml`} {
+			b := bytes.NewBuffer(nil)
+			require.NoError(t, StreamExport(id, b, format))
+			require.Equal(t, id.Export(c, format), b.String())
+		}
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.AddReference(c, "a:i1", "b:")
+		id.BumpEra(c)
+		id.RemoveInternal(c, "a:i2")
+
+		for _, format := range []string{`json`, `yaml`} {
+			b := bytes.NewBuffer(nil)
+			require.NoError(t, StreamExport(id, b, format))
+			require.Equal(t, id.Export(c, format), b.String())
+		}
+
+		// Records are read in batches
+		saved := StreamBatchSize
+		StreamBatchSize = 1
+		defer func() { StreamBatchSize = saved }()
+		id.Associate(c, "a:i3", "e3")
+		b := bytes.NewBuffer(nil)
+		require.NoError(t, StreamExport(id, b, `json`))
+		require.Equal(t, id.Export(c, `json`), b.String())
+		b = bytes.NewBuffer(nil)
+		require.NoError(t, streamExportBatches(id, b, `yaml`))
+		require.Equal(t, id.Export(c, `yaml`), b.String())
+		require.Error(t, StreamExport(id, bytes.NewBuffer(nil), `xml`))
+		require.Error(t, streamExportBatches(id, bytes.NewBuffer(nil), `xml`))
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestStreamExportSnapshot(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStreamExportSnapshot.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		o := DefaultOptions()
+		o.DB = filename
+		o.InitialMmapSize = 1 << 20
+		id := NewIdentityWithOptions(o)
+
+		saved := StreamBatchSize
+		StreamBatchSize = 1
+		defer func() { StreamBatchSize = saved }()
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.AddReference(c, "a:i1", "b:")
+		expected := id.Export(c, `json`)
+
+		// Changes committed while the document is written are not part of it
+		b := bytes.NewBuffer(nil)
+		changed := false
+		require.NoError(t, StreamExport(id, writerFunc(func(p []byte) (int, error) {
+			if !changed {
+				changed = true
+				id.PurgeInternal(c, "a:i2")
+				id.PurgeReferences(c, "a:i1")
+			}
+			return b.Write(p)
+		}), `json`))
+		require.True(t, changed)
+		require.Equal(t, expected, b.String())
+		require.NotEqual(t, expected, id.Export(c, `json`))
+	})
+}
@@ -0,0 +1,103 @@
+package identity
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// TeardownPlan returns the order in which the resources of a workflow should be deleted. The plan contains all
+// tuples that are keyed by an internalID prefixed by internalIDPrefix or by the prefix of a workflow that is
+// referenced from it, directly or transitively, regardless of the GC era of the references.
+//
+// Sub-workflows are torn down before the workflows that call on them and the tuples of each workflow are
+// ordered in the reverse order they were added to the store. The store is not modified.
+//
+// Each tuple is a seven element array as described for ValueTuple.
+func (i *identity) TeardownPlan(_ px.Context, internalIDPrefix string) px.List {
+	var plan []px.Value
+	i.withDb(func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			refs, err := readReferences(tx, func(*reference) bool { return true })
+			if err != nil {
+				return err
+			}
+			var tuples []*tuple
+			err = tx.Bucket(internalToExternal).ForEach(func(k, v []byte) error {
+				tuples = append(tuples, unmarshalTuple(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			tp := newTeardownPlanner(reachableReferences(refs, internalIDPrefix), internalIDPrefix, tuples)
+			tp.visit(internalIDPrefix)
+			plan = tp.plan
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return types.WrapValues(plan)
+}
+
+type teardownPlanner struct {
+	children map[string][]string
+	tuples   []*tuple
+	emitted  map[string]bool
+	visited  map[string]bool
+	plan     []px.Value
+}
+
+func newTeardownPlanner(refs []*reference, internalIDPrefix string, tuples []*tuple) *teardownPlanner {
+	known := make(map[string]bool, len(refs)+1)
+	known[internalIDPrefix] = true
+	for _, ref := range refs {
+		known[ref.ExternalID] = true
+	}
+
+	// Newest first so that the sub-workflows that were called last are torn down first
+	children := make(map[string][]string, len(known))
+	for ix := len(refs) - 1; ix >= 0; ix-- {
+		ref := refs[ix]
+		owner := ownerPrefix(known, ref.InternalID)
+		if !known[owner] {
+			owner = internalIDPrefix
+		}
+		children[owner] = append(children[owner], ref.ExternalID)
+	}
+
+	// Reverse of the order in which the tuples were added
+	sort.Slice(tuples, func(i, j int) bool {
+		return tuples[i].Seq > tuples[j].Seq
+	})
+
+	return &teardownPlanner{
+		children: children,
+		tuples:   tuples,
+		emitted:  make(map[string]bool, len(tuples)),
+		visited:  make(map[string]bool, len(known)),
+		plan:     make([]px.Value, 0, 32)}
+}
+
+// visit adds the tuples of all sub-workflows of the given prefix to the plan, followed by the
+// tuples of the prefix itself that were not already added
+func (tp *teardownPlanner) visit(prefix string) {
+	if tp.visited[prefix] {
+		return
+	}
+	tp.visited[prefix] = true
+	for _, child := range tp.children[prefix] {
+		tp.visit(child)
+	}
+	for _, t := range tp.tuples {
+		if !tp.emitted[t.InternalID] && strings.HasPrefix(t.InternalID, prefix) {
+			tp.emitted[t.InternalID] = true
+			tp.plan = append(tp.plan, t.ValueTuple())
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeardownPlan(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestTeardownPlan.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.AddReference(c, "a:i2", "b:")
+		id.Associate(c, "b:i1", "e2")
+		id.AddReference(c, "b:i2", "c:")
+		id.Associate(c, "c:i1", "e3")
+		id.Associate(c, "b:i3", "e4")
+		id.Associate(c, "a:i3", "e5")
+		id.Associate(c, "x:i1", "e6")
+
+		plan := id.TeardownPlan(c, "a:")
+		eids := make([]string, plan.Len())
+		plan.EachWithIndex(func(v px.Value, ix int) { eids[ix] = v.(px.List).At(1).String() })
+		require.Equal(t, []string{"e3", "e4", "e2", "e5", "e1"}, eids)
+
+		// Nothing is modified
+		require.EqualValues(t, 6, id.Search(c, "").Len())
+		require.EqualValues(t, 0, id.Garbage(c, "").Len())
+	})
+}
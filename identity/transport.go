@@ -0,0 +1,218 @@
+package identity
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lyraproj/data-protobuf/datapb"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/threadlocal"
+	"github.com/lyraproj/pcore/types"
+	sdkgrpc "github.com/lyraproj/servicesdk/grpc"
+	"github.com/lyraproj/servicesdk/servicepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamServiceName is the name of the gRPC service of the streaming methods
+const streamServiceName = `identity.Stream`
+
+// A streamCall runs a streaming method using the given arguments and sends each value of its result
+type streamCall func(c px.Context, s Service, args px.List, send func(px.Value) error) error
+
+// streamMethods are the streaming methods of the service
+var streamMethods = []struct {
+	name  string
+	arity int
+	call  streamCall
+}{
+	{`Search`, 2, func(c px.Context, s Service, args px.List, send func(px.Value) error) error {
+		return StreamSearch(c, s, args.At(0).String(), args.At(1).(px.OrderedMap), func(t px.List) error { return send(t) })
+	}},
+	{`Garbage`, 2, func(c px.Context, s Service, args px.List, send func(px.Value) error) error {
+		return StreamGarbage(c, s, args.At(0).String(), args.At(1).(px.OrderedMap), func(t px.List) error { return send(t) })
+	}},
+	{`Export`, 1, func(c px.Context, s Service, args px.List, send func(px.Value) error) error {
+		return streamExportBatches(s, chunkWriter(send), args.At(0).String())
+	}},
+}
+
+// streamServiceDesc describes the gRPC service of the streaming methods. Each method receives one
+// servicepb.InvokeRequest holding its arguments and sends each value of its result as a datapb.Data.
+var streamServiceDesc = grpc.ServiceDesc{
+	ServiceName: streamServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods:     []grpc.MethodDesc{},
+}
+
+func init() {
+	for _, m := range streamMethods {
+		streamServiceDesc.Streams = append(streamServiceDesc.Streams, grpc.StreamDesc{
+			StreamName:    m.name,
+			Handler:       streamHandler(m.name, m.arity, m.call),
+			ServerStreams: true,
+		})
+	}
+}
+
+func streamHandler(name string, arity int, call streamCall) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		return srv.(*streamServer).serve(stream, name, arity, call)
+	}
+}
+
+// StreamClient calls the streaming methods of a remote Identity service. Results are delivered as the service
+// reads them so neither side holds the whole result in memory.
+type StreamClient struct {
+	conn *grpc.ClientConn
+}
+
+// DialStream connects to the streaming methods of the Identity service at the given address, which is obtained
+// from the streamAddress method of the service. The client must be closed when it is no longer needed.
+func DialStream(address string) (*StreamClient, error) {
+	if address == `` {
+		return nil, errorf("the service does not serve streaming methods")
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(`unix`, addr, timeout)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return &StreamClient{conn: conn}, nil
+}
+
+// Close closes the connection of the client
+func (sc *StreamClient) Close() error {
+	return sc.conn.Close()
+}
+
+// Search calls yield with each tuple found by SearchFiltered on the remote service, as StreamSearch does locally
+func (sc *StreamClient) Search(c px.Context, internalIDPrefix string, filter px.OrderedMap, yield func(px.List) error) error {
+	return sc.call(c, `Search`, func(v px.Value) error { return yield(v.(px.List)) },
+		types.WrapString(internalIDPrefix), filterArgument(filter))
+}
+
+// Garbage calls yield with each tuple found by GarbageFiltered on the remote service, as StreamGarbage does locally
+func (sc *StreamClient) Garbage(c px.Context, internalIDPrefix string, filter px.OrderedMap, yield func(px.List) error) error {
+	return sc.call(c, `Garbage`, func(v px.Value) error { return yield(v.(px.List)) },
+		types.WrapString(internalIDPrefix), filterArgument(filter))
+}
+
+// Export writes the document exported by the remote service to the given writer, as StreamExport does locally
+func (sc *StreamClient) Export(c px.Context, w io.Writer, format string) error {
+	return sc.call(c, `Export`, func(v px.Value) error {
+		_, err := io.WriteString(w, v.String())
+		return err
+	}, types.WrapString(format))
+}
+
+// call invokes the named streaming method and calls yield with each value it sends. The call is cancelled when
+// yield returns an error, which is then returned.
+func (sc *StreamClient) call(c px.Context, method string, yield func(px.Value) error, args ...px.Value) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+
+	var desc *grpc.StreamDesc
+	for ix := range streamServiceDesc.Streams {
+		if streamServiceDesc.Streams[ix].StreamName == method {
+			desc = &streamServiceDesc.Streams[ix]
+		}
+	}
+	stream, err := sc.conn.NewStream(ctx, desc, `/`+streamServiceName+`/`+method)
+	if err != nil {
+		return err
+	}
+	if err = stream.SendMsg(&servicepb.InvokeRequest{Method: method, Arguments: sdkgrpc.ToDataPB(c, types.WrapValues(args))}); err == nil {
+		err = stream.CloseSend()
+	}
+	for err == nil {
+		d := &datapb.Data{}
+		if err = stream.RecvMsg(d); err == nil {
+			err = yield(sdkgrpc.FromDataPB(c, d))
+		}
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func filterArgument(filter px.OrderedMap) px.Value {
+	if filter == nil {
+		return px.EmptyMap
+	}
+	return filter
+}
+
+// streamServer serves the streaming methods of a service
+type streamServer struct {
+	ctx px.Context
+	id  Service
+}
+
+// serve reads the arguments of a streaming method from the given stream and runs the method, sending its
+// result on the stream. A panic is returned to the client as an error.
+func (s *streamServer) serve(stream grpc.ServerStream, name string, arity int, call streamCall) (err error) {
+	rq := &servicepb.InvokeRequest{}
+	if err = stream.RecvMsg(rq); err != nil {
+		return err
+	}
+	c := s.ctx.Fork()
+	defer func() {
+		if x := recover(); x != nil {
+			err = status.Errorf(codes.Unknown, "%v", x)
+		}
+	}()
+	threadlocal.Init()
+	threadlocal.Set(px.PuppetContextKey, c)
+	args, ok := sdkgrpc.FromDataPB(c, rq.Arguments).(px.List)
+	if !ok || args.Len() != arity {
+		return status.Errorf(codes.InvalidArgument, "%s expects %d arguments", name, arity)
+	}
+	return call(c, s.id, args, func(v px.Value) error {
+		return stream.SendMsg(sdkgrpc.ToDataPB(c, v))
+	})
+}
+
+// chunkWriter sends each chunk written to it as a String
+type chunkWriter func(px.Value) error
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	if err := w(types.WrapString(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serveStream serves the streaming methods of the given identity on a unix socket in a private temporary
+// directory and makes its address available through StreamAddress. The returned function stops the server and
+// removes the socket.
+func serveStream(c px.Context, id *identity) (func(), error) {
+	dir, err := ioutil.TempDir(``, `identity`)
+	if err != nil {
+		return nil, err
+	}
+	address := filepath.Join(dir, `stream.sock`)
+	l, err := net.Listen(`unix`, address)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	s := grpc.NewServer()
+	s.RegisterService(&streamServiceDesc, &streamServer{ctx: c, id: id})
+	go func() {
+		_ = s.Serve(l)
+	}()
+	id.streamAddress = address
+	return func() {
+		s.Stop()
+		_ = os.RemoveAll(dir)
+	}, nil
+}
@@ -0,0 +1,79 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/servicesdk/service"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamTransport(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStreamTransport.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		saved := StreamBatchSize
+		StreamBatchSize = 2
+		defer func() { StreamBatchSize = saved }()
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.Associate(c, "a:i3", "e3")
+		id.Associate(c, "b:i1", "f1")
+		id.BumpEra(c)
+		id.Sweep(c, "b:")
+
+		stopServer, err := serveStream(c, id.(*identity))
+		require.NoError(t, err)
+		defer stopServer()
+
+		// The address of the streaming methods is available through the API of the service
+		sb := service.NewServiceBuilder(c, "Identity")
+		sb.RegisterAPI("Identity::Service", id)
+		address := sb.Server().Invoke(c, "Identity::Service", "streamAddress").String()
+		require.Equal(t, id.StreamAddress(c), address)
+
+		sc, err := DialStream(address)
+		require.NoError(t, err)
+		defer sc.Close()
+
+		var ids []string
+		require.NoError(t, sc.Search(c, "a:", nil, func(t px.List) error {
+			ids = append(ids, t.At(0).String())
+			return nil
+		}))
+		require.Equal(t, []string{"a:i1", "a:i2", "a:i3"}, ids)
+
+		stop := errors.New("stop")
+		n := 0
+		require.Equal(t, stop, sc.Search(c, "", nil, func(t px.List) error {
+			if n++; n == 2 {
+				return stop
+			}
+			return nil
+		}))
+
+		ids = nil
+		require.NoError(t, sc.Garbage(c, "b:", nil, func(t px.List) error {
+			ids = append(ids, t.At(1).String())
+			return nil
+		}))
+		require.Equal(t, []string{"f1"}, ids)
+
+		b := bytes.NewBuffer(nil)
+		require.NoError(t, sc.Export(c, b, `yaml`))
+		require.Equal(t, id.Export(c, `yaml`), b.String())
+		err = sc.Export(c, bytes.NewBuffer(nil), `xml`)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `unknown document format 'xml'`)
+
+		_, err = DialStream(``)
+		require.Error(t, err)
+	})
+}
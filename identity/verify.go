@@ -0,0 +1,305 @@
+package identity
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/lyraproj/semver/semver"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A problem is an inconsistency found by Verify
+type problem struct {
+	kind     string
+	bucket   string
+	key      string
+	message  string
+	repaired bool
+}
+
+var allBuckets = [][]byte{metadata, internalToExternal, externalToInternal, garbage, references, history, audit, events}
+
+// Verify checks the consistency of the store and returns the problems that were found. When repair is true,
+// all problems that can be repaired are repaired within the same transaction.
+//
+// Each problem is a Hash with the entries kind, bucket, key, message, and repaired. The kinds are missingBucket,
+// invalidMetadata, staleSequence, undecodable, mismatchedKey, misplacedReference, asymmetricMapping,
+// duplicateExternal, danglingReverse, and shadowedGarbage. An empty slice is returned when the store is consistent.
+func (i *identity) Verify(_ px.Context, repair bool) px.List {
+	var problems []*problem
+	i.withDb(func(db *bolt.DB) {
+		check := func(tx *bolt.Tx) error {
+			v := &verifier{tx: tx, repair: repair, problems: make([]*problem, 0, 8)}
+			v.verify()
+			problems = v.problems
+			if repair && len(problems) > 0 && tx.Bucket(audit) != nil {
+				i.audit(tx, `verify`, nil)
+			}
+			return nil
+		}
+
+		var err error
+		if repair {
+			err = db.Update(check)
+		} else {
+			err = db.View(check)
+		}
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	ps := make([]px.Value, len(problems))
+	for ix, p := range problems {
+		i.log.Warn("found problem in identity store", "kind", p.kind, "bucket", p.bucket, "key", p.key, "message", p.message,
+			"repaired", p.repaired)
+		ps[ix] = p.valueHash()
+	}
+	return types.WrapValues(ps)
+}
+
+// VerifyFile verifies the store in the given file without first asserting that it has a valid format. This makes
+// it possible to repair stores that NewIdentity refuses to open.
+func VerifyFile(c px.Context, filename string, repair bool) px.List {
+	o := DefaultOptions()
+	o.DB = filename
+	return newIdentity(o).Verify(c, repair)
+}
+
+func (p *problem) valueHash() px.OrderedMap {
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`kind`, types.WrapString(p.kind)),
+		types.WrapHashEntry2(`bucket`, types.WrapString(p.bucket)),
+		types.WrapHashEntry2(`key`, types.WrapString(p.key)),
+		types.WrapHashEntry2(`message`, types.WrapString(p.message)),
+		types.WrapHashEntry2(`repaired`, types.WrapBoolean(p.repaired))})
+}
+
+type verifier struct {
+	tx       *bolt.Tx
+	repair   bool
+	problems []*problem
+}
+
+// records is the decoded contents of a bucket along with its keys in storage order
+type records struct {
+	keys   []string
+	values map[string]*tuple
+}
+
+func (v *verifier) verify() {
+	for _, bn := range allBuckets {
+		if v.tx.Bucket(bn) == nil {
+			bn := bn
+			v.report(`missingBucket`, bn, ``, func() {
+				if _, err := v.tx.CreateBucket(bn); err != nil {
+					panic(err)
+				}
+			}, "bucket '%s' is missing", bn)
+		}
+	}
+
+	live := v.readTuples(internalToExternal)
+	gbg := v.readTuples(garbage)
+	refs := v.readTuples(references)
+	hist := v.readTuples(history)
+	v.decodeRecords(audit, func(_, bs []byte) error {
+		r := &auditRecord{}
+		return decodeUnknown(string(audit), bs, &r)
+	})
+	v.decodeRecords(events, func(_, bs []byte) error {
+		e := &event{}
+		return decodeUnknown(string(events), bs, &e)
+	})
+	reverseKeys := make([]string, 0, len(live.keys))
+	stored := make(map[string]string, len(live.keys))
+	reverse := make(map[string]string, len(live.keys))
+	if b := v.tx.Bucket(externalToInternal); b != nil {
+		_ = b.ForEach(func(k, iid []byte) error {
+			reverseKeys = append(reverseKeys, string(k))
+			stored[string(k)] = string(iid)
+			reverse[string(k)] = string(iid)
+			return nil
+		})
+	}
+
+	v.verifyMetadata(live, gbg, refs, hist)
+
+	for _, k := range refs.keys {
+		r := refs.values[k]
+		if rk := string(refKey(r.InternalID, r.ExternalID)); rk != k {
+			v.report(`mismatchedKey`, references, k, func() {
+				deleteFromBucket(v.tx, references, []byte(k))
+				putInBucket(v.tx, references, []byte(rk), marshalReference(r))
+			}, "reference from '%s' to '%s' has wrong key", r.InternalID, r.ExternalID)
+			delete(refs.values, k)
+			refs.values[rk] = r
+		}
+	}
+
+	for _, k := range live.keys {
+		t := live.values[k]
+		iid := []byte(k)
+		if _, ok := refs.values[string(refKey(k, t.ExternalID))]; ok && reverse[t.ExternalID] != k {
+			v.report(`misplacedReference`, internalToExternal, k, func() {
+				deleteFromBucket(v.tx, internalToExternal, iid)
+			}, "reference from '%s' to '%s' is stored as a mapping", k, t.ExternalID)
+			delete(live.values, k)
+			continue
+		}
+
+		if t.InternalID != k {
+			v.report(`mismatchedKey`, internalToExternal, k, func() {
+				t.InternalID = k
+				putInBucket(v.tx, internalToExternal, iid, marshalTuple(t))
+			}, "mapping of '%s' has internal ID '%s'", k, t.InternalID)
+		}
+
+		rev, ok := reverse[t.ExternalID]
+		switch {
+		case !ok:
+			v.report(`asymmetricMapping`, internalToExternal, k, func() {
+				putInBucket(v.tx, externalToInternal, []byte(t.ExternalID), iid)
+			}, "external ID '%s' does not map back to internal ID '%s'", t.ExternalID, k)
+			reverse[t.ExternalID] = k
+		case rev == k:
+		case live.values[rev] != nil && live.values[rev].ExternalID == t.ExternalID:
+			v.report(`duplicateExternal`, internalToExternal, k, func() {
+				deleteFromBucket(v.tx, internalToExternal, iid)
+			}, "external ID '%s' is mapped from both '%s' and '%s'", t.ExternalID, k, rev)
+			delete(live.values, k)
+		default:
+			v.report(`asymmetricMapping`, internalToExternal, k, func() {
+				putInBucket(v.tx, externalToInternal, []byte(t.ExternalID), iid)
+			}, "external ID '%s' maps back to internal ID '%s' instead of '%s'", t.ExternalID, rev, k)
+			reverse[t.ExternalID] = k
+		}
+	}
+
+	for _, eid := range reverseKeys {
+		iid := stored[eid]
+		if reverse[eid] != iid {
+			// Reverse mapping was replaced above
+			continue
+		}
+		if t := live.values[iid]; t == nil || t.ExternalID != eid {
+			eid := eid
+			v.report(`danglingReverse`, externalToInternal, eid, func() {
+				deleteFromBucket(v.tx, externalToInternal, []byte(eid))
+			}, "external ID '%s' maps back to internal ID '%s' which does not map to it", eid, iid)
+			delete(reverse, eid)
+		}
+	}
+
+	for _, k := range gbg.keys {
+		t := gbg.values[k]
+		if t.ExternalID != k {
+			v.report(`mismatchedKey`, garbage, k, func() {
+				deleteFromBucket(v.tx, garbage, []byte(k))
+				putInBucket(v.tx, garbage, []byte(t.ExternalID), marshalTuple(t))
+			}, "garbage entry for '%s' has external ID '%s'", k, t.ExternalID)
+		}
+		if rev, ok := reverse[t.ExternalID]; ok && rev != t.InternalID {
+			v.report(`shadowedGarbage`, garbage, t.ExternalID, func() {
+				deleteFromBucket(v.tx, garbage, []byte(t.ExternalID))
+			}, "garbage entry for '%s' from internal ID '%s' shadows mapping from '%s'", t.ExternalID, t.InternalID, rev)
+		}
+	}
+}
+
+func (v *verifier) verifyMetadata(live, gbg, refs, hist *records) {
+	mb := v.tx.Bucket(metadata)
+	if mb == nil {
+		return
+	}
+
+	maxSeq := int64(0)
+	for _, rs := range []*records{live, gbg, refs, hist} {
+		for _, t := range rs.values {
+			if t.Seq > maxSeq {
+				maxSeq = t.Seq
+			}
+		}
+	}
+
+	md := &storeMeta{}
+	var err error
+	if bs := mb.Get(metadata); bs == nil {
+		err = errorf("metadata is missing")
+	} else if err = decodeUnknown(`metadata`, bs, &md); err == nil {
+		var ver semver.Version
+		if ver, err = semver.ParseVersion(md.Version); err == nil && !supportedVersions.Includes(ver) {
+			// Not something that can be repaired
+			v.report(`invalidMetadata`, metadata, string(metadata), nil,
+				"unsupported data store version. Expected %s, got %s", supportedVersions, md.Version)
+			return
+		}
+	}
+	if err != nil {
+		v.report(`invalidMetadata`, metadata, string(metadata), func() {
+			era := int64(0)
+			for _, t := range live.values {
+				if t.Era > era {
+					era = t.Era
+				}
+			}
+			putInBucket(v.tx, metadata, metadata, marshalMetadata(&storeMeta{Version: identityStoreVersion.String(), Timestamp: time.Now(), Era: era, Seq: maxSeq}))
+		}, "%s", err.Error())
+		return
+	}
+
+	if md.Seq < maxSeq {
+		v.report(`staleSequence`, metadata, string(metadata), func() {
+			md.Seq = maxSeq
+			putInBucket(v.tx, metadata, metadata, marshalMetadata(md))
+		}, "sequence %d of the store is lower than sequence %d of a record", md.Seq, maxSeq)
+	}
+}
+
+// readTuples decodes all records of the given bucket and reports those that cannot be decoded
+func (v *verifier) readTuples(bn []byte) *records {
+	rs := &records{keys: make([]string, 0, 32), values: make(map[string]*tuple, 32)}
+	v.decodeRecords(bn, func(k, bs []byte) error {
+		t := &tuple{}
+		if err := decodeUnknown(string(bn), bs, &t); err != nil {
+			return err
+		}
+		rs.keys = append(rs.keys, string(k))
+		rs.values[string(k)] = t
+		return nil
+	})
+	return rs
+}
+
+// decodeRecords calls decode with each record of the given bucket and reports the records that it fails to decode
+func (v *verifier) decodeRecords(bn []byte, decode func(k, bs []byte) error) {
+	b := v.tx.Bucket(bn)
+	if b == nil {
+		return
+	}
+	var bad [][]byte
+	var errs []error
+	_ = b.ForEach(func(k, bs []byte) error {
+		if err := decode(k, bs); err != nil {
+			bad = append(bad, append([]byte{}, k...))
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	for ix, k := range bad {
+		k := k
+		v.report(`undecodable`, bn, string(k), func() { deleteFromBucket(v.tx, bn, k) }, "%s", errs[ix].Error())
+	}
+}
+
+// report adds a problem and calls the repair function if repair is enabled and the function is not nil
+func (v *verifier) report(kind string, bucket []byte, key string, repair func(), format string, args ...interface{}) {
+	p := &problem{kind: kind, bucket: string(bucket), key: key, message: fmt.Sprintf(format, args...)}
+	if v.repair && repair != nil {
+		repair()
+		p.repaired = true
+	}
+	v.problems = append(v.problems, p)
+}
@@ -0,0 +1,147 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func corrupt(filename string, f func(tx *bolt.Tx) error) {
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if err = db.Update(f); err != nil {
+		panic(err)
+	}
+}
+
+func problemKinds(problems px.List) []string {
+	kinds := make([]string, problems.Len())
+	problems.EachWithIndex(func(p px.Value, ix int) { kinds[ix] = p.(px.OrderedMap).Get5("kind", nil).String() })
+	return kinds
+}
+
+func TestVerifyConsistentStore(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestVerifyConsistentStore.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.AddReference(c, "a:i3", "b:")
+		id.Associate(c, "b:i1", "e3")
+		id.BumpEra(c)
+		id.Associate(c, "a:i2", "e4")
+		id.Sweep(c, "a:")
+
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+	})
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestVerifyAndRepair.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "i1", "e1")
+		id.Associate(c, "i2", "e2")
+		id.Associate(c, "i3", "e3")
+		id.AddReference(c, "i4", "b:")
+
+		corrupt(filename, func(tx *bolt.Tx) error {
+			ie := tx.Bucket(internalToExternal)
+			ei := tx.Bucket(externalToInternal)
+			_ = ei.Delete([]byte("e1"))
+			_ = ei.Put([]byte("e9"), []byte("i9"))
+			_ = ie.Put([]byte("i5"), []byte("not a tuple"))
+			_ = ie.Put([]byte("i4"), marshalTuple(&tuple{InternalID: "i4", ExternalID: "b:"}))
+			_ = tx.Bucket(garbage).Put([]byte("e3"), marshalTuple(&tuple{InternalID: "i7", ExternalID: "e3"}))
+			return tx.DeleteBucket(metadata)
+		})
+
+		problems := id.Verify(c, false)
+		require.Equal(t, []string{
+			"missingBucket", "undecodable", "asymmetricMapping", "misplacedReference", "danglingReverse", "shadowedGarbage"},
+			problemKinds(problems))
+		problems.Each(func(p px.Value) { require.False(t, p.(px.OrderedMap).Get5("repaired", nil).(px.Boolean).Bool()) })
+
+		// Nothing was changed
+		require.EqualValues(t, 6, id.Verify(c, false).Len())
+
+		problems = id.Verify(c, true)
+		require.Equal(t, []string{
+			"missingBucket", "undecodable", "invalidMetadata", "asymmetricMapping", "misplacedReference", "danglingReverse", "shadowedGarbage"},
+			problemKinds(problems))
+		problems.Each(func(p px.Value) { require.True(t, p.(px.OrderedMap).Get5("repaired", nil).(px.Boolean).Bool()) })
+
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+		checkGetInternal(t, c, id, "e1", "i1")
+		checkGetExternal(t, c, id, "i4", "")
+		checkGetInternal(t, c, id, "e9", "")
+		require.EqualValues(t, 0, id.Garbage(c, "").Len())
+	})
+}
+
+func TestVerifyLogRecords(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestVerifyLogRecords.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+		corrupt(filename, func(tx *bolt.Tx) error {
+			for _, bn := range [][]byte{history, audit, events} {
+				if err := tx.Bucket(bn).Put([]byte("bad"), []byte("not a record")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		problems := id.Verify(c, true)
+		require.Equal(t, []string{"undecodable", "undecodable", "undecodable"}, problemKinds(problems))
+		buckets := make([]string, problems.Len())
+		problems.EachWithIndex(func(p px.Value, ix int) { buckets[ix] = p.(px.OrderedMap).Get5("bucket", nil).String() })
+		require.Equal(t, []string{string(history), string(audit), string(events)}, buckets)
+
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+		require.Equal(t, []string{`e1`}, historyIDs(id.History(c, "a:i1")))
+		require.Equal(t, []string{`associate`, `verify`}, auditOperations(id.Audit(c, "", nil)))
+	})
+}
+
+func TestAssociateAndAddReferenceStayConsistent(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestAssociateAndAddReferenceStayConsistent.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		// Taking an external ID from another mapping does not leave a garbage entry for it
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e1")
+		checkGetInternal(t, c, id, "e1", "a:i2")
+		checkGetExternal(t, c, id, "a:i1", "")
+		require.EqualValues(t, 0, id.Garbage(c, "").Len())
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+
+		// Refreshing a reference in a new era does not add it to the mappings
+		id.AddReference(c, "a:i3", "b:")
+		id.BumpEra(c)
+		id.AddReference(c, "a:i3", "b:")
+		require.EqualValues(t, 1, id.Search(c, "").Len())
+		require.EqualValues(t, 0, id.Verify(c, false).Len())
+	})
+}
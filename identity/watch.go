@@ -0,0 +1,198 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Kinds of events returned by Watch
+const (
+	EventAssociate = `associate`
+	EventRemove    = `remove`
+	EventGarbage   = `garbage`
+	EventPurge     = `purge`
+	EventBumpEra   = `bumpEra`
+	EventRestore   = `restore`
+)
+
+// WatchRetention is the number of events that the store retains for Watch
+var WatchRetention uint64 = 10000
+
+// WatchBatchSize is the maximum number of events returned by one call to Watch
+var WatchBatchSize = 256
+
+// MaxWatchWait is the maximum number of milliseconds that one call to Watch waits for events. Longer waits are
+// shortened to it.
+var MaxWatchWait int64 = 60000
+
+// WatchPollInterval is how often a waiting Watch reads the store to find events committed by other processes.
+// Events committed by this service end the wait as soon as they are committed.
+var WatchPollInterval = time.Second
+
+// An event records a change to a mapping, or a bump of the GC-era or a restore in which case the tuple is nil
+type event struct {
+	Seq       int64
+	Kind      string
+	Tuple     *tuple
+	Era       int64
+	Timestamp time.Time
+}
+
+// Watch returns the events that were committed after the position given by token and that concern a mapping
+// whose internal ID is prefixed by internalIDPrefix. Era bumps and restores concern all mappings. An empty token starts at
+// the current end of the event log. When no such events exist, Watch waits up to wait milliseconds, but no more
+// than MaxWatchWait, for one to be committed before it returns.
+//
+// The result is a Hash with the entries events and next where next is the token to pass to resume after the
+// returned events. Each event is a Hash with the entries seq, kind, tuple, era, and timestamp. The kind is one of
+//
+//	associate  a mapping was created
+//	remove     a mapping was removed and moved to the garbage bin, either explicitly or because it was replaced
+//	garbage    a mapping was moved to the garbage bin by a sweep
+//	purge      a mapping or garbage entry was permanently deleted
+//	bumpEra    the GC-era was bumped
+//	restore    the store was restored from a snapshot. It is followed by associate and purge events for the
+//	           mappings that the restore changed
+//
+// The tuple is described by ValueTuple and is undefined for bumpEra and restore. The era is the GC-era after the
+// change. The store retains the latest WatchRetention events, also across a restore. It is an error to resume
+// using a token that refers to an event that is no longer retained or that is beyond the end of the event log.
+func (i *identity) Watch(_ px.Context, internalIDPrefix, token string, wait int64) px.OrderedMap {
+	var after []byte
+	if token != `` {
+		after = decodeToken(`watch`, internalIDPrefix, token)
+		if len(after) != 8 {
+			panic(errorf("invalid continuation token '%s' for watch of '%s'", token, internalIDPrefix))
+		}
+	}
+
+	if wait > MaxWatchWait {
+		wait = MaxWatchWait
+	}
+	deadline := time.Now().Add(time.Duration(wait) * time.Millisecond)
+	for {
+		// Obtain the channel before reading so that no commit goes unnoticed
+		changed := i.changes()
+		var found []px.Value
+		i.withDb(func(db *bolt.DB) {
+			err := db.View(func(tx *bolt.Tx) error {
+				found, after = readEvents(tx.Bucket(events), internalIDPrefix, after, token)
+				return nil
+			})
+			if err != nil {
+				panic(err)
+			}
+		})
+		remaining := time.Until(deadline)
+		if len(found) > 0 || remaining <= 0 {
+			return types.WrapHash([]*types.HashEntry{
+				types.WrapHashEntry2(`events`, types.WrapValues(found)),
+				types.WrapHashEntry2(`next`, types.WrapString(encodeToken(`watch`, internalIDPrefix, string(after))))})
+		}
+		if remaining > WatchPollInterval {
+			remaining = WatchPollInterval
+		}
+		select {
+		case <-changed:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// readEvents reads at most WatchBatchSize events with the given prefix that follow the given position. A nil
+// position is the current end of the log. Returns the events and the position of the last event read.
+func readEvents(b *bolt.Bucket, internalIDPrefix string, after []byte, token string) ([]px.Value, []byte) {
+	if after == nil {
+		return nil, eventKey(b.Sequence())
+	}
+	// A token beyond the end of the log was issued for another store, such as one that replaced the file
+	if binary.BigEndian.Uint64(after) > b.Sequence() {
+		panic(errorf("continuation token '%s' for watch of '%s' has expired", token, internalIDPrefix))
+	}
+	c := b.Cursor()
+	if k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) > binary.BigEndian.Uint64(after)+1 {
+		panic(errorf("continuation token '%s' for watch of '%s' has expired", token, internalIDPrefix))
+	}
+
+	found := make([]px.Value, 0, 8)
+	k, v := c.Seek(after)
+	if bytes.Equal(k, after) {
+		k, v = c.Next()
+	}
+	for ; k != nil && len(found) < WatchBatchSize; k, v = c.Next() {
+		after = append([]byte{}, k...)
+		e := &event{}
+		unmarshalUnknown(`event`, v, &e)
+		if e.Tuple == nil || strings.HasPrefix(e.Tuple.InternalID, internalIDPrefix) {
+			found = append(found, e.valueHash())
+		}
+	}
+	return found, after
+}
+
+// emit appends an event to the event log of the store and wakes up the watchers when the transaction commits
+func (i *identity) emit(tx *bolt.Tx, kind string, t *tuple) {
+	if t == nil && kind != EventBumpEra && kind != EventRestore {
+		return
+	}
+	b := tx.Bucket(events)
+	seq, err := b.NextSequence()
+	if err != nil {
+		panic(err)
+	}
+	e := &event{Seq: int64(seq), Kind: kind, Tuple: t, Era: i.readMetadata(tx).Era, Timestamp: time.Now()}
+	putInBucket(tx, events, eventKey(seq), marshalUnknown(`event`, e))
+
+	// Discard events that are no longer retained
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k)+WatchRetention <= seq; k, _ = c.First() {
+		if err = c.Delete(); err != nil {
+			panic(err)
+		}
+	}
+	tx.OnCommit(i.signalChanges)
+}
+
+func eventKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// changes returns a channel that is closed when the next change is committed by this service
+func (i *identity) changes() chan struct{} {
+	i.changeLock.Lock()
+	defer i.changeLock.Unlock()
+	if i.changed == nil {
+		i.changed = make(chan struct{})
+	}
+	return i.changed
+}
+
+func (i *identity) signalChanges() {
+	i.changeLock.Lock()
+	defer i.changeLock.Unlock()
+	if i.changed != nil {
+		close(i.changed)
+		i.changed = nil
+	}
+}
+
+func (e *event) valueHash() px.OrderedMap {
+	var t px.Value = px.Undef
+	if e.Tuple != nil {
+		t = e.Tuple.ValueTuple()
+	}
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`seq`, types.WrapInteger(e.Seq)),
+		types.WrapHashEntry2(`kind`, types.WrapString(e.Kind)),
+		types.WrapHashEntry2(`tuple`, t),
+		types.WrapHashEntry2(`era`, types.WrapInteger(e.Era)),
+		types.WrapHashEntry2(`timestamp`, types.WrapTimestamp(e.Timestamp))})
+}
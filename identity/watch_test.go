@@ -0,0 +1,172 @@
+package identity
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/stretchr/testify/require"
+)
+
+func eventKinds(r px.OrderedMap) []string {
+	es := r.Get5(`events`, nil).(px.List)
+	kinds := make([]string, es.Len())
+	es.EachWithIndex(func(e px.Value, ix int) { kinds[ix] = e.(px.OrderedMap).Get5(`kind`, nil).String() })
+	return kinds
+}
+
+func TestWatch(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestWatch.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		id.Associate(c, "a:i1", "e1")
+
+		// An empty token starts at the end of the log
+		r := id.Watch(c, "a:", "", 0)
+		require.EqualValues(t, 0, r.Get5(`events`, nil).(px.List).Len())
+		token := r.Get5(`next`, nil).String()
+
+		id.Associate(c, "a:i1", "e2")
+		id.Associate(c, "b:i1", "e3")
+		id.BumpEra(c)
+		id.Sweep(c, "a:")
+		id.PurgeInternal(c, "a:i1")
+
+		r = id.Watch(c, "a:", token, 0)
+		require.Equal(t, []string{`remove`, `associate`, `bumpEra`, `garbage`, `purge`, `purge`, `purge`}, eventKinds(r))
+		e := r.Get5(`events`, nil).(px.List).At(1).(px.OrderedMap)
+		require.Equal(t, `e2`, e.Get5(`tuple`, nil).(px.List).At(1).String())
+		require.Equal(t, px.Undef, r.Get5(`events`, nil).(px.List).At(2).(px.OrderedMap).Get5(`tuple`, nil))
+
+		// Resuming with the next token returns nothing new
+		token = r.Get5(`next`, nil).String()
+		r = id.Watch(c, "a:", token, 0)
+		require.EqualValues(t, 0, r.Get5(`events`, nil).(px.List).Len())
+		require.Equal(t, token, r.Get5(`next`, nil).String())
+
+		// Events of other prefixes advance the token without being returned
+		id.Associate(c, "b:i2", "e4")
+		r = id.Watch(c, "a:", token, 0)
+		require.EqualValues(t, 0, r.Get5(`events`, nil).(px.List).Len())
+		require.NotEqual(t, token, r.Get5(`next`, nil).String())
+
+		require.Panics(t, func() { id.Watch(c, "b:", token, 0) })
+	})
+}
+
+func TestWatchWaits(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestWatchWaits.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+		token := id.Watch(c, "", "", 0).Get5(`next`, nil).String()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			id.Associate(c, "a:i1", "e1")
+		}()
+		start := time.Now()
+		r := id.Watch(c, "", token, 10000)
+		require.Equal(t, []string{`associate`}, eventKinds(r))
+		require.True(t, time.Since(start) < 5*time.Second)
+
+		start = time.Now()
+		r = id.Watch(c, "", r.Get5(`next`, nil).String(), 50)
+		require.EqualValues(t, 0, r.Get5(`events`, nil).(px.List).Len())
+		require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+		// Waits are capped
+		saved := MaxWatchWait
+		MaxWatchWait = 50
+		defer func() { MaxWatchWait = saved }()
+		start = time.Now()
+		r = id.Watch(c, "", r.Get5(`next`, nil).String(), 1<<40)
+		require.EqualValues(t, 0, r.Get5(`events`, nil).(px.List).Len())
+		require.True(t, time.Since(start) < 5*time.Second)
+	})
+}
+
+func TestWatchPollsOtherWriters(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestWatchPollsOtherWriters.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+		token := id.Watch(c, "", "", 0).Get5(`next`, nil).String()
+
+		saved := WatchPollInterval
+		WatchPollInterval = 20 * time.Millisecond
+		defer func() { WatchPollInterval = saved }()
+
+		// A second service on the same store stands in for another process. Its commits do not wake up the
+		// watchers of the first, which find them when polling.
+		other := NewIdentity(filename)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			other.Associate(c, "a:i1", "e1")
+		}()
+		start := time.Now()
+		r := id.Watch(c, "", token, 10000)
+		require.Equal(t, []string{`associate`}, eventKinds(r))
+		require.True(t, time.Since(start) < 5*time.Second)
+	})
+}
+
+func TestWatchRetention(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestWatchRetention.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+
+		saved := WatchRetention
+		WatchRetention = 3
+		defer func() { WatchRetention = saved }()
+
+		token := id.Watch(c, "", "", 0).Get5(`next`, nil).String()
+		id.BumpEra(c)
+		id.BumpEra(c)
+		require.Equal(t, []string{`bumpEra`, `bumpEra`}, eventKinds(id.Watch(c, "", token, 0)))
+
+		id.BumpEra(c)
+		id.BumpEra(c)
+		require.Panics(t, func() { id.Watch(c, "", token, 0) })
+	})
+}
+
+func TestStreamWatch(t *testing.T) {
+	pcore.Do(func(c px.Context) {
+		filename := "TestStreamWatch.db"
+		deleteFile(filename)
+		defer deleteFile(filename)
+		id := NewIdentity(filename)
+		token := id.Watch(c, "a:", "", 0).Get5(`next`, nil).String()
+		id.Associate(c, "a:i1", "e1")
+		id.Associate(c, "a:i2", "e2")
+		id.Associate(c, "a:i3", "e3")
+
+		done := errors.New(`done`)
+		var ids []string
+		var resume string
+		err := StreamWatch(c, id, "a:", token, 0, func(e px.OrderedMap, token string) error {
+			ids = append(ids, e.Get5(`tuple`, nil).(px.List).At(0).String())
+			if len(ids) == 2 {
+				resume = token
+				return done
+			}
+			return nil
+		})
+		require.Equal(t, done, err)
+		require.Equal(t, []string{`a:i1`, `a:i2`}, ids)
+
+		// The token given with an event resumes after that event
+		r := id.Watch(c, "a:", resume, 0)
+		require.EqualValues(t, 1, r.Get5(`events`, nil).(px.List).Len())
+	})
+}
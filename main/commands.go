@@ -0,0 +1,596 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lyraproj/identity/identity"
+	"github.com/lyraproj/pcore/pcore"
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+)
+
+// A command is a subcommand of the identity binary that operates directly on a store file
+type command struct {
+	synopsis string
+	help     string
+	run      func(iv *invocation, args []string)
+
+	// creates is true when the command creates the store if it does not exist. Other commands fail instead so
+	// that a mistyped --db does not go unnoticed
+	creates bool
+}
+
+// An invocation holds the state of one command execution
+type invocation struct {
+	name    string
+	creates bool
+	flags   *flag.FlagSet
+	options *identity.Options
+	ctx     px.Context
+	out     io.Writer
+}
+
+// usageError is raised when a command is invoked with invalid flags or arguments
+type usageError string
+
+var commands map[string]*command
+
+// statusTimeout is the time that the status command waits for a lock before reporting the store as locked
+const statusTimeout = 500 * time.Millisecond
+
+func init() {
+	commands = map[string]*command{
+		`associate`: {
+			synopsis: `internalID externalID`,
+			help:     `Associate an internal and external ID with each other`,
+			run:      associate,
+			creates:  true,
+		},
+		`audit`: {
+			synopsis: `[--min-era n] [--max-era n] [--after time] [--before time] [prefix]`,
+			help:     `Print the audit records of changes to mappings and references with the given internal ID prefix`,
+			run:      printAudit,
+		},
+		`backup`: {
+			synopsis: `file`,
+			help:     `Write a consistent snapshot of the store to file`,
+			run:      backup,
+		},
+		`bump-era`: {
+			help: `Bump the current GC era and print the new era`,
+			run:  bumpEra,
+		},
+		`compact`: {
+			help: `Rewrite the store into a fresh file to reclaim unused space`,
+			run:  compact,
+		},
+		`export`: {
+			synopsis: `[--format json|yaml] [--out file]`,
+			help:     `Export mappings, garbage, references, and metadata of the store`,
+			run:      export,
+		},
+		`garbage`: {
+			synopsis: `[--min-era n] [--max-era n] [--after time] [--before time] [--limit n [--token token]] [prefix]`,
+			help:     `Print the garbage of the workflow with the given internal ID prefix`,
+			run:      listGarbage,
+		},
+		`get`: {
+			synopsis: `[--external | --as-of time] id`,
+			help:     `Print the mapping of an internal ID, or of an external ID when --external is given, without touching its GC era`,
+			run:      get,
+		},
+		`graph`: {
+			synopsis: `[--format dot|json] [prefix]`,
+			help:     `Print the graph of references that extends from prefix`,
+			run:      graph,
+		},
+		`history`: {
+			synopsis: `internalID`,
+			help:     `Print the external IDs that an internal ID has been associated with over time`,
+			run:      printHistory,
+		},
+		`import`: {
+			synopsis: `[--format json|yaml] [--conflict fail|overwrite|skip] file`,
+			help:     `Import a document produced by export into the store`,
+			run:      importDocument,
+			creates:  true,
+		},
+		`purge`: {
+			synopsis: `[--external|--references] id`,
+			help:     `Remove the mappings of an ID from the store and the garbage bin, or purge references`,
+			run:      purge,
+		},
+		`remove`: {
+			synopsis: `[--external] id`,
+			help:     `Move the mappings of an internal ID, or of an external ID, to the garbage bin`,
+			run:      remove,
+		},
+		`restore`: {
+			synopsis: `file`,
+			help:     `Replace the store with a snapshot written by backup`,
+			run:      restore,
+		},
+		`rotate-audit`: {
+			synopsis: `[--before time] file`,
+			help:     `Move audit records older than the given time, or all records, to a JSON-lines file`,
+			run:      rotateAudit,
+		},
+		`search`: {
+			synopsis: `[--external] [--match prefix|glob|regex] [--min-era n] [--max-era n] [--after time] [--before time] [--limit n [--token token]] [pattern]`,
+			help:     `Print the mappings whose internal ID, or external ID, matches the pattern`,
+			run:      search,
+		},
+		`serve`: {
+			help: `Start the Identity service`,
+			run:  serve,
+		},
+		`stats`: {
+			synopsis: `[prefix]`,
+			help:     `Print statistics about the mappings, garbage, and references with the given prefix`,
+			run:      stats,
+		},
+		`status`: {
+			help: `Print whether the store is locked and which process owns it`,
+			run:  status,
+		},
+		`sweep`: {
+			synopsis: `prefix`,
+			help:     `Move the mappings of a workflow that are eligible for garbage collection to the garbage bin`,
+			run:      sweep,
+		},
+		`verify`: {
+			synopsis: `[--repair]`,
+			help:     `Check the consistency of the store and optionally repair it`,
+			run:      verify,
+		},
+		`watch`: {
+			synopsis: `[--token token] [prefix]`,
+			help:     `Print changes to the mappings with the given internal ID prefix as they are committed`,
+			run:      watch,
+		},
+		`help`: {
+			help: `Print this help`,
+			run: func(iv *invocation, args []string) {
+				iv.parse(args, 0, 0)
+				printUsage(iv.out)
+			},
+		},
+	}
+}
+
+// run executes the named command, writing results to stdout and errors to stderr, and returns the exit code of
+// the process
+func run(name string, args []string, stdout, stderr io.Writer) (exit int) {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "identity: unknown command '%s'\n\n", name)
+		printUsage(stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	iv := &invocation{name: name, creates: cmd.creates, flags: fs, out: stdout}
+	addSettingFlags(fs)
+
+	defer func() {
+		if x := recover(); x != nil {
+			if ue, ok := x.(usageError); ok {
+				fmt.Fprintf(stderr, "identity %s: %s\nusage: identity %s [--db file] %s\n", name, string(ue), name, cmd.synopsis)
+				fs.SetOutput(stderr)
+				fs.PrintDefaults()
+				exit = 2
+				return
+			}
+			fmt.Fprintf(stderr, "identity %s: %v\n", name, x)
+			exit = 1
+		}
+	}()
+	pcore.Do(func(c px.Context) {
+		iv.ctx = c
+		cmd.run(iv, args)
+	})
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "usage: identity [command [--db file] [arguments]]")
+	fmt.Fprintln(w, "\nWithout a command, the Identity service is started as if by the serve command. Commands:")
+	for _, n := range names {
+		c := commands[n]
+		fmt.Fprintf(w, "  %-12s %s\n", n, c.help)
+	}
+	fmt.Fprintln(w, "\nResults are printed as JSON. Use 'identity <command> --help' to list the flags of a command.")
+	fmt.Fprintln(w, "Settings are read from a configuration file, the environment, and flags, in order of increasing precedence.")
+}
+
+// parse parses the flags of the invocation, loads the options of the store, and returns the remaining arguments after asserting that their
+// count is within the given bounds
+func (iv *invocation) parse(args []string, min, max int) []string {
+	if err := iv.flags.Parse(args); err != nil {
+		panic(usageError(err.Error()))
+	}
+	o, err := loadOptions(iv.flags)
+	if err != nil {
+		panic(err)
+	}
+	iv.options = o
+
+	rest := iv.flags.Args()
+	if len(rest) < min || len(rest) > max {
+		if min == max {
+			panic(usageError(fmt.Sprintf("expected %d arguments, got %d", min, len(rest))))
+		}
+		panic(usageError(fmt.Sprintf("expected %d to %d arguments, got %d", min, max, len(rest))))
+	}
+	return rest
+}
+
+// open opens the identity store designated by the options of the invocation
+func (iv *invocation) open() identity.Service {
+	if !iv.creates {
+		iv.assertExists()
+	}
+	return identity.NewIdentityWithOptions(iv.options)
+}
+
+// assertExists asserts that the store designated by the options of the invocation exists
+func (iv *invocation) assertExists() {
+	if _, err := os.Stat(iv.options.DB); os.IsNotExist(err) {
+		panic(fmt.Errorf("identity store '%s' does not exist", iv.options.DB))
+	}
+}
+
+// arg returns the argument at the given index or the empty string when no such argument exists
+func arg(args []string, index int) string {
+	if index < len(args) {
+		return args[index]
+	}
+	return ``
+}
+
+func graph(iv *invocation, args []string) {
+	format := iv.flags.String(`format`, `dot`, `output format, dot or json`)
+	args = iv.parse(args, 0, 1)
+	fmt.Fprintln(iv.out, strings.TrimSuffix(iv.open().ReferenceGraph(iv.ctx, arg(args, 0), *format), "\n"))
+}
+
+func verify(iv *invocation, args []string) {
+	repair := iv.flags.Bool(`repair`, false, `repair the problems that can be repaired`)
+	iv.parse(args, 0, 0)
+	iv.assertExists()
+	problems := identity.VerifyFile(iv.ctx, iv.options.DB, *repair)
+	writeJSON(iv.out, problems)
+	if !*repair && problems.Len() > 0 {
+		panic(fmt.Sprintf("%d problems found", problems.Len()))
+	}
+}
+
+// documentFormat returns the given format or, if it is empty, the format implied by the file extension
+func documentFormat(format, file string) string {
+	if format == `` {
+		format = `json`
+		switch filepath.Ext(file) {
+		case `.yaml`, `.yml`:
+			format = `yaml`
+		}
+	}
+	return format
+}
+
+func export(iv *invocation, args []string) {
+	format := iv.flags.String(`format`, ``, `document format, json or yaml. Default is implied by --out`)
+	out := iv.flags.String(`out`, ``, `file to write the document to. Default is stdout`)
+	iv.parse(args, 0, 0)
+	f := documentFormat(*format, *out)
+
+	w := iv.out
+	if *out != `` {
+		file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		w = file
+	}
+
+	// Stream the document so that large stores are not held in memory
+	err := identity.StreamExport(iv.open(), w, f)
+	if err == nil && f == `json` {
+		_, err = io.WriteString(w, "\n")
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func importDocument(iv *invocation, args []string) {
+	format := iv.flags.String(`format`, ``, `document format, json or yaml. Default is implied by the file extension`)
+	conflict := iv.flags.String(`conflict`, identity.ConflictFail, `conflict handling, fail, overwrite, or skip`)
+	file := iv.parse(args, 1, 1)[0]
+
+	var doc []byte
+	var err error
+	if file == `-` {
+		doc, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		doc, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		panic(err)
+	}
+	writeJSON(iv.out, iv.open().Import(iv.ctx, string(doc), documentFormat(*format, file), *conflict))
+}
+
+func backup(iv *invocation, args []string) {
+	file := iv.parse(args, 1, 1)[0]
+	iv.open().Backup(iv.ctx, file)
+}
+
+func restore(iv *invocation, args []string) {
+	file := iv.parse(args, 1, 1)[0]
+	iv.open().Restore(iv.ctx, file)
+}
+
+func compact(iv *invocation, args []string) {
+	iv.parse(args, 0, 0)
+	writeJSON(iv.out, iv.open().Compact(iv.ctx))
+}
+
+// tupleFields are the names of the elements of the tuples returned by the Identity service
+var tupleFields = []string{`internalId`, `externalId`, `timestamp`, `era`, `seq`, `associated`, `seen`}
+
+// tupleHashes converts a list of tuples to a list of hashes keyed by tupleFields
+func tupleHashes(tuples px.List) px.List {
+	hs := make([]px.Value, tuples.Len())
+	tuples.EachWithIndex(func(t px.Value, ix int) {
+		tl := t.(px.List)
+		es := make([]*types.HashEntry, 0, len(tupleFields))
+		for fx, f := range tupleFields {
+			if fx < tl.Len() {
+				es = append(es, types.WrapHashEntry2(f, tl.At(fx)))
+			}
+		}
+		hs[ix] = types.WrapHash(es)
+	})
+	return types.WrapValues(hs)
+}
+
+func serve(iv *invocation, args []string) {
+	iv.parse(args, 0, 0)
+	identity.Serve(iv.ctx, iv.options)
+}
+
+func get(iv *invocation, args []string) {
+	external := iv.flags.Bool(`external`, false, `look up the internal ID of an external ID`)
+	asOf := iv.flags.String(`as-of`, ``, `look up the mapping at a time in RFC 3339 format or as a duration before now such as 24h`)
+	id := iv.parse(args, 1, 1)[0]
+
+	var internalID, externalID string
+	var found bool
+	if *asOf != `` {
+		if *external {
+			panic(usageError(`--as-of cannot be combined with --external`))
+		}
+		internalID = id
+		at := filterTime(`as-of`, *asOf).(*types.Timestamp).Time()
+		externalID, found = iv.open().GetExternalAsOf(iv.ctx, id, at)
+	} else if *external {
+		externalID = id
+		internalID, found = iv.open().PeekInternal(iv.ctx, id)
+	} else {
+		internalID = id
+		externalID, found = iv.open().PeekExternal(iv.ctx, id)
+	}
+	writeJSON(iv.out, types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`internalId`, types.WrapString(internalID)),
+		types.WrapHashEntry2(`externalId`, types.WrapString(externalID)),
+		types.WrapHashEntry2(`found`, types.WrapBoolean(found))}))
+}
+
+func printHistory(iv *invocation, args []string) {
+	id := iv.parse(args, 1, 1)[0]
+	writeJSON(iv.out, tupleHashes(iv.open().History(iv.ctx, id)))
+}
+
+func associate(iv *invocation, args []string) {
+	args = iv.parse(args, 2, 2)
+	iv.open().Associate(iv.ctx, args[0], args[1])
+}
+
+func remove(iv *invocation, args []string) {
+	external := iv.flags.Bool(`external`, false, `remove the mappings of an external ID`)
+	id := iv.parse(args, 1, 1)[0]
+	if *external {
+		iv.open().RemoveExternal(iv.ctx, id)
+	} else {
+		iv.open().RemoveInternal(iv.ctx, id)
+	}
+}
+
+func purge(iv *invocation, args []string) {
+	external := iv.flags.Bool(`external`, false, `purge the mappings of an external ID`)
+	refs := iv.flags.Bool(`references`, false, `purge all references extending from an internal ID prefix in eras less than the current era`)
+	id := iv.parse(args, 1, 1)[0]
+	switch {
+	case *external && *refs:
+		panic(usageError(`--external and --references are mutually exclusive`))
+	case *external:
+		iv.open().PurgeExternal(iv.ctx, id)
+	case *refs:
+		iv.open().PurgeReferences(iv.ctx, id)
+	default:
+		iv.open().PurgeInternal(iv.ctx, id)
+	}
+}
+
+func search(iv *invocation, args []string) {
+	limit, token := pageFlags(iv)
+	filter := filterFlags(iv)
+	external := iv.flags.Bool(`external`, false, `match external IDs instead of internal IDs`)
+	mode := iv.flags.String(`match`, identity.MatchPrefix, `how the pattern is matched, prefix, glob, or regex`)
+	args = iv.parse(args, 0, 1)
+	if *external || *mode != identity.MatchPrefix {
+		if *limit > 0 || filter().Len() > 0 {
+			panic(usageError(`--limit and filters can only be used with internal ID prefixes`))
+		}
+		field := identity.FieldInternal
+		if *external {
+			field = identity.FieldExternal
+		}
+		writeJSON(iv.out, tupleHashes(iv.open().SearchMatching(iv.ctx, field, *mode, arg(args, 0))))
+	} else if *limit > 0 {
+		writeJSON(iv.out, pageHashes(iv.open().SearchPage(iv.ctx, arg(args, 0), filter(), *limit, *token)))
+	} else {
+		writeJSON(iv.out, tupleHashes(iv.open().SearchFiltered(iv.ctx, arg(args, 0), filter())))
+	}
+}
+
+func listGarbage(iv *invocation, args []string) {
+	limit, token := pageFlags(iv)
+	filter := filterFlags(iv)
+	args = iv.parse(args, 0, 1)
+	if *limit > 0 {
+		writeJSON(iv.out, pageHashes(iv.open().GarbagePage(iv.ctx, arg(args, 0), filter(), *limit, *token)))
+	} else {
+		writeJSON(iv.out, tupleHashes(iv.open().GarbageFiltered(iv.ctx, arg(args, 0), filter())))
+	}
+}
+
+// pageFlags adds the flags that control pagination to the invocation
+func pageFlags(iv *invocation) (limit *int64, token *string) {
+	limit = iv.flags.Int64(`limit`, 0, `maximum number of tuples to print, 0 prints all`)
+	token = iv.flags.String(`token`, ``, `continuation token from the next entry of a previous page`)
+	return
+}
+
+// filterFlags adds the flags that filter tuples by era and timestamp to the invocation. The returned function
+// builds the filter Hash once the flags have been parsed.
+func filterFlags(iv *invocation) func() px.OrderedMap {
+	minEra := iv.flags.Int64(`min-era`, -1, `lowest GC era, inclusive`)
+	maxEra := iv.flags.Int64(`max-era`, -1, `highest GC era, inclusive`)
+	after := iv.flags.String(`after`, ``, `earliest timestamp, inclusive, in RFC 3339 format or as a duration before now such as 24h`)
+	before := iv.flags.String(`before`, ``, `latest timestamp, exclusive, in RFC 3339 format or as a duration before now such as 24h`)
+	return func() px.OrderedMap {
+		es := make([]*types.HashEntry, 0, 4)
+		if *minEra >= 0 {
+			es = append(es, types.WrapHashEntry2(`minEra`, types.WrapInteger(*minEra)))
+		}
+		if *maxEra >= 0 {
+			es = append(es, types.WrapHashEntry2(`maxEra`, types.WrapInteger(*maxEra)))
+		}
+		if *after != `` {
+			es = append(es, types.WrapHashEntry2(`after`, filterTime(`after`, *after)))
+		}
+		if *before != `` {
+			es = append(es, types.WrapHashEntry2(`before`, filterTime(`before`, *before)))
+		}
+		return types.WrapHash(es)
+	}
+}
+
+// filterTime converts the value of a timestamp flag into a Timestamp
+func filterTime(name, value string) px.Value {
+	if d, err := time.ParseDuration(value); err == nil {
+		return types.WrapTimestamp(time.Now().Add(-d))
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		panic(usageError(fmt.Sprintf("--%s must be an RFC 3339 timestamp or a duration, got '%s'", name, value)))
+	}
+	return types.WrapTimestamp(t)
+}
+
+// pageHashes converts the tuples of a page to hashes keyed by tupleFields
+func pageHashes(page px.OrderedMap) px.OrderedMap {
+	return types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`tuples`, tupleHashes(page.Get5(`tuples`, nil).(px.List))),
+		types.WrapHashEntry2(`next`, page.Get5(`next`, nil))})
+}
+
+func sweep(iv *invocation, args []string) {
+	prefix := iv.parse(args, 1, 1)[0]
+	iv.open().Sweep(iv.ctx, prefix)
+}
+
+func bumpEra(iv *invocation, args []string) {
+	iv.parse(args, 0, 0)
+	id := iv.open()
+	id.BumpEra(iv.ctx)
+	writeJSON(iv.out, types.WrapHash([]*types.HashEntry{types.WrapHashEntry2(`era`, types.WrapInteger(id.ReadEra(iv.ctx)))}))
+}
+
+func status(iv *invocation, args []string) {
+	iv.parse(args, 0, 0)
+	writeJSON(iv.out, identity.Status(iv.options.DB, statusTimeout))
+}
+
+func printAudit(iv *invocation, args []string) {
+	filter := filterFlags(iv)
+	args = iv.parse(args, 0, 1)
+	records := iv.open().Audit(iv.ctx, arg(args, 0), filter())
+	hs := make([]px.Value, records.Len())
+	records.EachWithIndex(func(r px.Value, ix int) {
+		rh := r.(px.OrderedMap)
+		hs[ix] = rh.Merge(types.WrapHash([]*types.HashEntry{
+			types.WrapHashEntry2(`tuples`, tupleHashes(rh.Get5(`tuples`, nil).(px.List)))}))
+	})
+	writeJSON(iv.out, types.WrapValues(hs))
+}
+
+func rotateAudit(iv *invocation, args []string) {
+	before := iv.flags.String(`before`, ``, `rotate records older than this time in RFC 3339 format or as a duration before now such as 24h`)
+	args = iv.parse(args, 1, 1)
+	var at time.Time
+	if *before != `` {
+		at = filterTime(`before`, *before).(*types.Timestamp).Time()
+	}
+	fmt.Fprintln(iv.out, iv.open().RotateAudit(iv.ctx, args[0], at))
+}
+
+// watchWait is the number of milliseconds that each call to Watch made by the watch command waits for events
+const watchWait = 30000
+
+func watch(iv *invocation, args []string) {
+	token := iv.flags.String(`token`, ``, `resume after the event with this token instead of starting with new events`)
+	args = iv.parse(args, 0, 1)
+	err := identity.StreamWatch(iv.ctx, iv.open(), arg(args, 0), *token, watchWait, func(e px.OrderedMap, token string) error {
+		return writeJSONLine(iv.out, e.Merge(types.WrapHash([]*types.HashEntry{
+			types.WrapHashEntry2(`tuple`, eventTuple(e.Get5(`tuple`, nil))),
+			types.WrapHashEntry2(`token`, types.WrapString(token))})))
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// eventTuple converts the tuple of an event to a hash keyed by tupleFields
+func eventTuple(t px.Value) px.Value {
+	if l, ok := t.(px.List); ok {
+		return tupleHashes(types.WrapValues([]px.Value{l})).At(0)
+	}
+	return t
+}
+
+func stats(iv *invocation, args []string) {
+	args = iv.parse(args, 0, 1)
+	writeJSON(iv.out, iv.open().Stats(iv.ctx, arg(args, 0)))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runCommand runs the named command against the store db and returns its exit code, stdout, and stderr
+func runCommand(db, name string, args ...string) (int, string, string) {
+	var out, errOut bytes.Buffer
+	exit := run(name, append([]string{`--db`, db, `--log-level`, `error`}, args...), &out, &errOut)
+	return exit, out.String(), errOut.String()
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `identity`)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, `identity.db`)
+	bak := filepath.Join(dir, `identity.bak`)
+	doc := filepath.Join(dir, `identity.yaml`)
+
+	tests := []struct {
+		name string
+		args []string
+		exit int
+		out  string
+		err  string
+	}{
+		{`get`, []string{`a:i1`}, 1, ``, `identity store '` + db + `' does not exist`},
+		{`verify`, nil, 1, ``, `does not exist`},
+		{`associate`, []string{`a:i1`, `e1`}, 0, ``, ``},
+		{`associate`, []string{`a:i2`, `e2`}, 0, ``, ``},
+		{`associate`, []string{`a:i3`}, 2, ``, `expected 2 arguments, got 1`},
+		{`get`, []string{`a:i1`}, 0, `"externalId": "e1"`, ``},
+		{`get`, []string{`--external`, `e2`}, 0, `"internalId": "a:i2"`, ``},
+		{`get`, []string{`a:i9`}, 0, `"found": false`, ``},
+		{`get`, []string{`--external`, `--as-of`, `1h`, `e2`}, 2, ``, `--as-of cannot be combined with --external`},
+		{`get`, []string{`--as-of`, `yesterday`, `a:i1`}, 2, ``, `--as-of must be an RFC 3339 timestamp or a duration`},
+		{`search`, []string{`a:`}, 0, `"internalId": "a:i2"`, ``},
+		{`search`, []string{`--limit`, `1`, `a:`}, 0, `"next": "`, ``},
+		{`search`, []string{`--external`, `--limit`, `1`, `e`}, 2, ``, `--limit and filters can only be used`},
+		{`search`, []string{`--timeout`, `soon`}, 1, ``, `flag --timeout`},
+		{`backup`, []string{bak}, 0, ``, ``},
+		{`bump-era`, nil, 0, `"era": 1`, ``},
+		{`remove`, []string{`a:i2`}, 0, ``, ``},
+		{`garbage`, []string{`a:`}, 0, `"externalId": "e2"`, ``},
+		{`sweep`, []string{`a:`}, 0, ``, ``},
+		{`garbage`, []string{`a:`}, 0, `"externalId": "e1"`, ``},
+		{`history`, []string{`a:i2`}, 0, `"externalId": ""`, ``},
+		{`audit`, []string{`a:i1`}, 0, `"operation": "sweep"`, ``},
+		{`stats`, nil, 0, `"garbage": 2`, ``},
+		{`purge`, []string{`--external`, `--references`, `e1`}, 2, ``, `mutually exclusive`},
+		{`restore`, []string{bak}, 0, ``, ``},
+		{`get`, []string{`a:i2`}, 0, `"externalId": "e2"`, ``},
+		{`purge`, []string{`a:i2`}, 0, ``, ``},
+		{`export`, []string{`--out`, doc}, 0, ``, ``},
+		{`import`, []string{`--conflict`, `skip`, doc}, 0, `"mappings": 1`, ``},
+		{`verify`, nil, 0, `[]`, ``},
+		{`compact`, nil, 0, `"before": `, ``},
+		{`status`, nil, 0, `"locked": false`, ``},
+		{`help`, nil, 0, `usage: identity`, ``},
+		{`frobnicate`, nil, 2, ``, `unknown command 'frobnicate'`},
+	}
+	for _, tc := range tests {
+		exit, out, errOut := runCommand(db, tc.name, tc.args...)
+		require.Equal(t, tc.exit, exit, "%s %v: %s", tc.name, tc.args, errOut)
+		require.Contains(t, out, tc.out, "%s %v", tc.name, tc.args)
+		require.Contains(t, errOut, tc.err, "%s %v", tc.name, tc.args)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/lyraproj/identity/identity"
+)
+
+// settingFlags maps the command line flags that configure the store to the name of the corresponding setting
+var settingFlags = map[string]string{
+	`db`:        identity.OptionDB,
+	`file-mode`: identity.OptionFileMode,
+	`timeout`:   identity.OptionTimeout,
+	`sync`:      identity.OptionSync,
+	`log-level`: identity.OptionLogLevel,
+	`caller`:    identity.OptionCaller,
+
+	`freelist-sync`:     identity.OptionFreelistSync,
+	`initial-mmap-size`: identity.OptionInitialMmapSize,
+}
+
+// addSettingFlags adds the flags that configure the store to the given flag set
+func addSettingFlags(fs *flag.FlagSet) {
+	d := identity.DefaultOptions()
+	fs.String(`config`, ``, `configuration file in JSON or YAML format (env `+identity.EnvConfig+`)`)
+	fs.String(`db`, ``, settingHelp(`path to the identity store`, d.DB, identity.OptionDB))
+	fs.String(`file-mode`, ``, settingHelp(`permissions of a new store file`, fmt.Sprintf("%#o", d.FileMode), identity.OptionFileMode))
+	fs.String(`timeout`, ``, settingHelp(`time to wait for the store lock, 0 waits indefinitely`, d.Timeout.String(), identity.OptionTimeout))
+	fs.String(`sync`, ``, settingHelp(`sync the store file after each transaction`, fmt.Sprint(d.Sync), identity.OptionSync))
+	fs.String(`freelist-sync`, ``, settingHelp(`write the freelist to the store file`, fmt.Sprint(d.FreelistSync), identity.OptionFreelistSync))
+	fs.String(`initial-mmap-size`, ``, settingHelp(`initial size in bytes of the memory map of the store`, fmt.Sprint(d.InitialMmapSize), identity.OptionInitialMmapSize))
+	fs.String(`log-level`, ``, settingHelp(`trace, debug, info, warn, or error`, d.LogLevel, identity.OptionLogLevel))
+	fs.String(`caller`, ``, settingHelp(`identity recorded in the audit log`, `the current user`, identity.OptionCaller))
+}
+
+func settingHelp(help, dflt, setting string) string {
+	return fmt.Sprintf("%s (default %s, env %s)", help, dflt, identity.OptionEnv[setting])
+}
+
+// loadOptions returns the options obtained by applying, in order of increasing precedence, the defaults, the
+// configuration file, the environment, and the flags that were set in the given flag set
+func loadOptions(fs *flag.FlagSet) (*identity.Options, error) {
+	o := identity.DefaultOptions()
+
+	config := os.Getenv(identity.EnvConfig)
+	if f := fs.Lookup(`config`); f != nil && f.Value.String() != `` {
+		config = f.Value.String()
+	}
+	if config != `` {
+		if err := o.ReadFile(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.ReadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if name, ok := settingFlags[f.Name]; ok && err == nil {
+			if err = o.Set(name, f.Value.String()); err != nil {
+				err = fmt.Errorf("flag --%s: %s", f.Name, err)
+			}
+		}
+	})
+	if err == nil {
+		err = o.Validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	configureLogging(o)
+	return o, nil
+}
+
+// configureLogging applies the log level of the given options to the default logger
+func configureLogging(o *identity.Options) {
+	level := hclog.LevelFromString(o.LogLevel)
+	hclog.DefaultOptions.Level = level
+	hclog.Default().SetLevel(level)
+}
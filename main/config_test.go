@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/lyraproj/identity/identity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `identity`)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, `identity.yaml`)
+	require.NoError(t, ioutil.WriteFile(config, []byte("db: config.db\ntimeout: 3s\nlogLevel: warn\n"), 0600))
+
+	defer configureLogging(identity.DefaultOptions())
+
+	// The environment takes precedence over the configuration file and flags over the environment
+	require.NoError(t, os.Setenv(identity.OptionEnv[identity.OptionTimeout], `5s`))
+	defer os.Unsetenv(identity.OptionEnv[identity.OptionTimeout])
+	fs := flag.NewFlagSet(`test`, flag.ContinueOnError)
+	addSettingFlags(fs)
+	require.NoError(t, fs.Parse([]string{`--config`, config, `--db`, `flag.db`}))
+
+	o, err := loadOptions(fs)
+	require.NoError(t, err)
+	require.Equal(t, `flag.db`, o.DB)
+	require.Equal(t, 5*time.Second, o.Timeout)
+	require.Equal(t, `warn`, o.LogLevel)
+	require.False(t, hclog.Default().IsInfo())
+
+	fs = flag.NewFlagSet(`test`, flag.ContinueOnError)
+	addSettingFlags(fs)
+	require.NoError(t, fs.Parse([]string{`--file-mode`, `0400`}))
+	_, err = loadOptions(fs)
+	require.Error(t, err)
+
+	fs = flag.NewFlagSet(`test`, flag.ContinueOnError)
+	addSettingFlags(fs)
+	require.NoError(t, fs.Parse([]string{`--config`, filepath.Join(dir, `missing.json`)}))
+	_, err = loadOptions(fs)
+	require.Error(t, err)
+}
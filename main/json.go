@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+)
+
+// writeJSON writes the given value as indented JSON. Hashes are written as objects that retain the order of
+// their entries and timestamps are written as RFC3339 strings
+func writeJSON(w io.Writer, v px.Value) {
+	b := bytes.NewBuffer(nil)
+	appendJSON(b, v)
+	ib := bytes.NewBuffer(nil)
+	if err := json.Indent(ib, b.Bytes(), ``, `  `); err != nil {
+		panic(err)
+	}
+	ib.WriteByte('\n')
+	if _, err := ib.WriteTo(w); err != nil {
+		panic(err)
+	}
+}
+
+// writeJSONLine writes the given value as JSON on a single line
+func writeJSONLine(w io.Writer, v px.Value) error {
+	b := bytes.NewBuffer(nil)
+	appendJSON(b, v)
+	b.WriteByte('\n')
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func appendJSON(b *bytes.Buffer, v px.Value) {
+	switch v := v.(type) {
+	case px.StringValue:
+		// Must precede px.List since strings are indexed
+		appendScalar(b, v.String())
+	case px.OrderedMap:
+		b.WriteByte('{')
+		v.EachWithIndex(func(e px.Value, ix int) {
+			if ix > 0 {
+				b.WriteByte(',')
+			}
+			me := e.(px.MapEntry)
+			appendScalar(b, me.Key().String())
+			b.WriteByte(':')
+			appendJSON(b, me.Value())
+		})
+		b.WriteByte('}')
+	case px.List:
+		b.WriteByte('[')
+		v.EachWithIndex(func(e px.Value, ix int) {
+			if ix > 0 {
+				b.WriteByte(',')
+			}
+			appendJSON(b, e)
+		})
+		b.WriteByte(']')
+	case *types.Timestamp:
+		appendScalar(b, v.Time().Format(time.RFC3339Nano))
+	case px.Integer:
+		appendScalar(b, v.Int())
+	case px.Float:
+		appendScalar(b, v.Float())
+	case px.Boolean:
+		appendScalar(b, v.Bool())
+	case *types.UndefValue:
+		b.WriteString(`null`)
+	default:
+		panic(fmt.Errorf("unable to write a %s as JSON", v.PType()))
+	}
+}
+
+func appendScalar(b *bytes.Buffer, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	b.Write(bs)
+}
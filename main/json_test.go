@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/lyraproj/pcore/px"
+	"github.com/lyraproj/pcore/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteJSON(t *testing.T) {
+	ts := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	v := types.WrapHash([]*types.HashEntry{
+		types.WrapHashEntry2(`id`, types.WrapString(`a:i1`)),
+		types.WrapHashEntry2(`era`, types.WrapInteger(2)),
+		types.WrapHashEntry2(`found`, types.WrapBoolean(true)),
+		types.WrapHashEntry2(`at`, types.WrapTimestamp(ts)),
+		types.WrapHashEntry2(`tags`, types.WrapValues([]px.Value{types.WrapString(`x`), px.Undef}))})
+
+	b := bytes.NewBuffer(nil)
+	writeJSON(b, v)
+	require.Equal(t, `{
+  "id": "a:i1",
+  "era": 2,
+  "found": true,
+  "at": "2019-06-01T12:00:00Z",
+  "tags": [
+    "x",
+    null
+  ]
+}
+`, b.String())
+
+	b.Reset()
+	require.NoError(t, writeJSONLine(b, v))
+	require.Equal(t, `{"id":"a:i1","era":2,"found":true,"at":"2019-06-01T12:00:00Z","tags":["x",null]}`+"\n", b.String())
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 
 	"github.com/hashicorp/go-hclog"
@@ -19,5 +21,13 @@ func init() {
 }
 
 func main() {
-	identity.Start("identity.db")
+	if len(os.Args) > 1 {
+		os.Exit(run(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
+	}
+	o, err := loadOptions(flag.NewFlagSet(`identity`, flag.ContinueOnError))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "identity: %s\n", err)
+		os.Exit(1)
+	}
+	identity.StartWithOptions(o)
 }